@@ -0,0 +1,70 @@
+// Copyright 2013 X-Formation. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+)
+
+// ----------------------------------------------------------------------------
+// Built-in service
+// ----------------------------------------------------------------------------
+
+// BuiltinService is the name under which the server registers its own
+// methods, such as "rpc.listMethods".
+const BuiltinService = "rpc"
+
+// MethodDescription describes a registered method.
+type MethodDescription struct {
+	// Name of the method in dotted notation as in "Service.Method".
+	Name string
+	// JSON encoded zero value of the method args.
+	Args json.RawMessage
+	// JSON encoded zero value of the method reply.
+	Reply json.RawMessage
+}
+
+// ListMethodsArgs holds the args of the "rpc.listMethods" method.
+type ListMethodsArgs struct {
+}
+
+// ListMethodsReply holds the reply of the "rpc.listMethods" method.
+type ListMethodsReply struct {
+	Methods []MethodDescription
+}
+
+// builtinService implements the methods registered under BuiltinService.
+type builtinService struct {
+	services *serviceMap
+}
+
+// ListMethods describes all the methods registered in the server.
+func (b *builtinService) ListMethods(r *http.Request, args *ListMethodsArgs, reply *ListMethodsReply) error {
+	reply.Methods = b.services.describe()
+	return nil
+}
+
+// byName sorts method descriptions by name.
+type byName []MethodDescription
+
+func (d byName) Len() int           { return len(d) }
+func (d byName) Less(i, j int) bool { return d[i].Name < d[j].Name }
+func (d byName) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+// zeroJSON returns the JSON encoding of the zero value of a type, or null
+// if the type cannot be encoded.
+func zeroJSON(t reflect.Type) json.RawMessage {
+	if t == nil {
+		// Streaming methods and methods writing the response have no reply.
+		return json.RawMessage("null")
+	}
+	b, err := json.Marshal(reflect.Zero(t).Interface())
+	if err != nil {
+		return json.RawMessage("null")
+	}
+	return b
+}
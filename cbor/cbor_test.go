@@ -0,0 +1,191 @@
+// Copyright 2013 X-Formation. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cbor
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/x-formation/rpc"
+	rpcjson "github.com/x-formation/rpc/json"
+)
+
+var ErrResponseError = errors.New("response error")
+
+type Service1Request struct {
+	A     int
+	B     int
+	Label string `json:"label"`
+}
+
+type Service1Response struct {
+	Result int
+	Label  string `json:"label"`
+}
+
+type Service1 struct {
+}
+
+func (t *Service1) Multiply(r *http.Request, req *Service1Request, res *Service1Response) error {
+	res.Result = req.A * req.B
+	res.Label = req.Label
+	return nil
+}
+
+func (t *Service1) ResponseError(r *http.Request, req *Service1Request, res *Service1Response) error {
+	return ErrResponseError
+}
+
+func execute(t *testing.T, s *rpc.Server, method string, req, res interface{}) error {
+	buf, err := EncodeClientRequest(method, req)
+	if err != nil {
+		t.Fatal("Expected nil err, but got", err)
+	}
+	r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewReader(buf))
+	r.Header.Set("Content-Type", "application/cbor")
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+
+	if ct := w.Header().Get("Content-Type"); ct != "application/cbor" {
+		t.Errorf("Expected application/cbor Content-Type, but got %q", ct)
+	}
+	return DecodeClientResponse(w.Body, res)
+}
+
+func TestService(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/cbor")
+	s.RegisterService(new(Service1), "")
+
+	var res Service1Response
+	if err := execute(t, s, "Service1.Multiply", &Service1Request{-4, 300, "négatif"}, &res); err != nil {
+		t.Error("Expected err to be nil, but got", err)
+	}
+	if res.Result != -1200 || res.Label != "négatif" {
+		t.Errorf("Wrong response: %+v.", res)
+	}
+	if err := execute(t, s, "Service1.ResponseError", &Service1Request{}, &res); err == nil || err.Error() != ErrResponseError.Error() {
+		t.Errorf("Expected to get %q, but got %v", ErrResponseError, err)
+	}
+}
+
+func TestMethodHeader(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/cbor")
+	s.RegisterService(new(Service1), "")
+
+	buf, _ := marshal(map[string]interface{}{"params": &Service1Request{A: 4, B: 2}})
+	r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewReader(buf))
+	r.Header.Set("Content-Type", "application/cbor")
+	r.Header.Set(MethodHeader, "Service1.Multiply")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+
+	var res Service1Response
+	if err := DecodeClientResponse(w.Body, &res); err != nil || res.Result != 8 {
+		t.Errorf("Expected 8 with nil err, but got %v (%v)", res.Result, err)
+	}
+}
+
+func TestPayloadSize(t *testing.T) {
+	req := &Service1Request{A: 4, B: 2, Label: "size"}
+	c, err := EncodeClientRequest("Service1.Multiply", req)
+	if err != nil {
+		t.Fatal("Expected nil err, but got", err)
+	}
+	j, err := rpcjson.EncodeClientRequest("Service1.Multiply", req)
+	if err != nil {
+		t.Fatal("Expected nil err, but got", err)
+	}
+	if len(c) >= len(j) {
+		t.Errorf("Expected CBOR request smaller than %d JSON bytes, but got %d", len(j), len(c))
+	}
+	t.Logf("CBOR request: %d bytes, JSON request: %d bytes", len(c), len(j))
+}
+
+func TestEncoding(t *testing.T) {
+	// Examples from RFC 7049, appendix A.
+	table := []struct {
+		value interface{}
+		data  []byte
+	}{
+		{uint64(0), []byte{0x00}},
+		{uint64(23), []byte{0x17}},
+		{uint64(24), []byte{0x18, 0x18}},
+		{uint64(1000), []byte{0x19, 0x03, 0xe8}},
+		{uint64(1000000), []byte{0x1a, 0x00, 0x0f, 0x42, 0x40}},
+		{uint64(18446744073709551615), []byte{0x1b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{int64(-1000), []byte{0x39, 0x03, 0xe7}},
+		{1.1, []byte{0xfb, 0x3f, 0xf1, 0x99, 0x99, 0x99, 0x99, 0x99, 0x9a}},
+		{false, []byte{0xf4}},
+		{nil, []byte{0xf6}},
+		{"IETF", []byte{0x64, 0x49, 0x45, 0x54, 0x46}},
+		{[]interface{}{uint64(1), []interface{}{uint64(2), uint64(3)}}, []byte{0x82, 0x01, 0x82, 0x02, 0x03}},
+		{map[string]interface{}{"a": uint64(1), "b": []interface{}{uint64(2)}}, []byte{0xa2, 0x61, 0x61, 0x01, 0x61, 0x62, 0x81, 0x02}},
+	}
+	for _, rec := range table {
+		data, err := marshal(rec.value)
+		if err != nil || !bytes.Equal(data, rec.data) {
+			t.Errorf("Expected %v to encode as %x, but got %x (%v)", rec.value, rec.data, data, err)
+		}
+		d := &decoder{data: rec.data}
+		if v, err := d.decode(0); err != nil || !reflect.DeepEqual(v, rec.value) {
+			t.Errorf("Expected %x to decode as %v, but got %v (%v)", rec.data, rec.value, v, err)
+		}
+	}
+	halves := []struct {
+		data  []byte
+		value float64
+	}{
+		{[]byte{0xf9, 0x3c, 0x00}, 1},
+		{[]byte{0xf9, 0xc4, 0x00}, -4},
+		{[]byte{0xf9, 0x00, 0x01}, 5.960464477539063e-8},
+		{[]byte{0xf9, 0x7c, 0x00}, math.Inf(1)},
+		{[]byte{0xfa, 0x47, 0xc3, 0x50, 0x00}, 100000},
+	}
+	for _, rec := range halves {
+		d := &decoder{data: rec.data}
+		if v, err := d.decode(0); err != nil || v != rec.value {
+			t.Errorf("Expected %x to decode as %v, but got %v (%v)", rec.data, rec.value, v, err)
+		}
+	}
+	for _, data := range [][]byte{{0x19, 0x03}, {0x82, 0x01}, {0x9f, 0x01, 0xff}, {0xa1, 0x01, 0x02}} {
+		d := &decoder{data: data}
+		if _, err := d.decode(0); err == nil {
+			t.Errorf("Expected err decoding %x", data)
+		}
+	}
+}
+
+func TestResponseCodecHeader(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/cbor")
+	s.RegisterCodec(rpcjson.NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	buf, _ := rpcjson.EncodeClientRequest("Service1.Multiply", &Service1Request{A: 4, B: 2})
+	r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewReader(buf))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set(rpc.ResponseCodecHeader, "application/cbor")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+
+	if w.Code != 200 {
+		t.Errorf("Expected status 200, but got %d: %s", w.Code, w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json; charset=utf-8" {
+		t.Errorf("Expected the request codec to respond, but got %q", ct)
+	}
+	var res Service1Response
+	if err := rpcjson.DecodeClientResponse(w.Body, &res); err != nil || res.Result != 8 {
+		t.Errorf("Expected 8 with nil err, but got %v (%v)", res.Result, err)
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright 2013 X-Formation. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cbor
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+)
+
+// ----------------------------------------------------------------------------
+// Request and Response
+// ----------------------------------------------------------------------------
+
+// clientRequest represents a request sent by a client.
+type clientRequest struct {
+	// A String containing the name of the method to be invoked.
+	Method string `json:"method"`
+	// Object to pass as request parameter to the method.
+	Params interface{} `json:"params"`
+	// The request id, used to match the response with the request.
+	Id uint64 `json:"id"`
+}
+
+// EncodeClientRequest encodes parameters for a CBOR RPC client request.
+func EncodeClientRequest(method string, args interface{}) ([]byte, error) {
+	c := &clientRequest{
+		Method: method,
+		Params: args,
+		Id:     uint64(rand.Int63()),
+	}
+	return marshal(c)
+}
+
+// DecodeClientResponse decodes the response body of a client request into
+// the interface reply.
+func DecodeClientResponse(r io.Reader, reply interface{}) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	d := &decoder{data: data}
+	generic, err := d.decode(0)
+	if err != nil {
+		return err
+	}
+	res, ok := generic.(map[string]interface{})
+	if !ok {
+		return errors.New("rpc: response ill-formed: expected a CBOR map")
+	}
+	if res["error"] != nil {
+		return fmt.Errorf("%v", res["error"])
+	}
+	return fromGeneric(res["result"], reply)
+}
@@ -0,0 +1,50 @@
+// Copyright 2013 X-Formation. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+Package cbor provides a codec for RPC over HTTP services using CBOR, the
+Concise Binary Object Representation of RFC 7049.
+
+To register the codec in a RPC server:
+
+	import (
+		"http"
+		"github.com/x-formation/rpc"
+		"github.com/x-formation/rpc/cbor"
+	)
+
+	func init() {
+		s := rpc.NewServer()
+		s.RegisterCodec(cbor.NewCodec(), "application/cbor")
+		// [...]
+		http.Handle("/rpc", s)
+	}
+
+Request format is a CBOR map with text keys:
+
+	method:
+		The name of the method to be invoked, as a string in dotted notation
+		as in "Service.Method". It may be sent in the X-RPC-Method header
+		instead.
+	params:
+		The object to pass as argument to the method.
+	id:
+		The request id. It is used to match the response with the request
+		that it is replying to.
+
+Response format is a CBOR map with text keys:
+
+	result:
+		The Object that was returned by the invoked method,
+		or null in case there was an error invoking the method.
+	error:
+		The error message if there was an error invoking the method,
+		or null if there was no error.
+	id:
+		The same id as the request it is responding to.
+
+Args and replies are mapped to CBOR items as the encoding/json package maps
+them to JSON ones, so their struct tags apply.
+*/
+package cbor
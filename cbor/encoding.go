@@ -0,0 +1,310 @@
+// Copyright 2013 X-Formation. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cbor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// CBOR major types.
+const (
+	majorUint   = 0
+	majorNegInt = 1
+	majorBytes  = 2
+	majorText   = 3
+	majorArray  = 4
+	majorMap    = 5
+	majorTag    = 6
+	majorSimple = 7
+)
+
+var errTruncated = errors.New("rpc: truncated CBOR data")
+
+// maxDepth limits the nesting of decoded arrays and maps.
+const maxDepth = 64
+
+// marshal returns the CBOR encoding of v.
+//
+// Values are mapped to CBOR items as encoding/json maps them to JSON ones, so
+// that struct tags and json.Marshaler implementations are honored: structs
+// and maps become maps with text keys, and numbers become integers whenever
+// they have no fractional part.
+func marshal(v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var generic interface{}
+	if err := decoder.Decode(&generic); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := encode(&buf, generic); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// unmarshal decodes the CBOR data into v, following the mapping of marshal.
+// Byte strings are decoded as for []byte fields.
+func unmarshal(data []byte, v interface{}) error {
+	d := &decoder{data: data}
+	generic, err := d.decode(0)
+	if err != nil {
+		return err
+	}
+	if d.off != len(d.data) {
+		return errors.New("rpc: trailing data after CBOR item")
+	}
+	return fromGeneric(generic, v)
+}
+
+// fromGeneric assigns a decoded CBOR item to v.
+func fromGeneric(generic, v interface{}) error {
+	data, err := json.Marshal(generic)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// ----------------------------------------------------------------------------
+// Encoding
+// ----------------------------------------------------------------------------
+
+// encode writes the CBOR item of a value decoded from JSON.
+func encode(buf *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteByte(0xf6)
+	case bool:
+		if v {
+			buf.WriteByte(0xf5)
+		} else {
+			buf.WriteByte(0xf4)
+		}
+	case json.Number:
+		if n, err := strconv.ParseInt(string(v), 10, 64); err == nil {
+			if n < 0 {
+				writeHead(buf, majorNegInt, uint64(-(n + 1)))
+			} else {
+				writeHead(buf, majorUint, uint64(n))
+			}
+		} else if n, err := strconv.ParseUint(string(v), 10, 64); err == nil {
+			writeHead(buf, majorUint, n)
+		} else {
+			f, err := strconv.ParseFloat(string(v), 64)
+			if err != nil {
+				return err
+			}
+			buf.WriteByte(0xfb)
+			binary.Write(buf, binary.BigEndian, math.Float64bits(f))
+		}
+	case string:
+		writeHead(buf, majorText, uint64(len(v)))
+		buf.WriteString(v)
+	case []interface{}:
+		writeHead(buf, majorArray, uint64(len(v)))
+		for _, item := range v {
+			if err := encode(buf, item); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		writeHead(buf, majorMap, uint64(len(v)))
+		for _, key := range keys {
+			writeHead(buf, majorText, uint64(len(key)))
+			buf.WriteString(key)
+			if err := encode(buf, v[key]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("rpc: cannot encode %T to CBOR", v)
+	}
+	return nil
+}
+
+// writeHead writes the initial bytes of an item, in the shortest form.
+func writeHead(buf *bytes.Buffer, major byte, n uint64) {
+	major <<= 5
+	switch {
+	case n < 24:
+		buf.WriteByte(major | byte(n))
+	case n <= math.MaxUint8:
+		buf.WriteByte(major | 24)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(major | 25)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	case n <= math.MaxUint32:
+		buf.WriteByte(major | 26)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	default:
+		buf.WriteByte(major | 27)
+		binary.Write(buf, binary.BigEndian, n)
+	}
+}
+
+// ----------------------------------------------------------------------------
+// Decoding
+// ----------------------------------------------------------------------------
+
+// decoder reads CBOR items into generic values: nil, bool, int64, uint64,
+// float64, string, []byte, []interface{} and map[string]interface{}.
+type decoder struct {
+	data []byte
+	off  int
+}
+
+// decode reads the next item.
+func (d *decoder) decode(depth int) (interface{}, error) {
+	if depth > maxDepth {
+		return nil, errors.New("rpc: CBOR data nested too deeply")
+	}
+	major, info, n, err := d.head()
+	if err != nil {
+		return nil, err
+	}
+	switch major {
+	case majorUint:
+		return n, nil
+	case majorNegInt:
+		if n > math.MaxInt64 {
+			return nil, errors.New("rpc: CBOR integer overflows int64")
+		}
+		return -int64(n) - 1, nil
+	case majorBytes, majorText:
+		b, err := d.bytes(n)
+		if err != nil {
+			return nil, err
+		}
+		if major == majorText {
+			return string(b), nil
+		}
+		return append([]byte(nil), b...), nil
+	case majorArray:
+		if n > uint64(len(d.data)-d.off) {
+			return nil, errTruncated
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = d.decode(depth + 1); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	case majorMap:
+		if n > uint64(len(d.data)-d.off) {
+			return nil, errTruncated
+		}
+		items := make(map[string]interface{}, n)
+		for i := uint64(0); i < n; i++ {
+			key, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			name, ok := key.(string)
+			if !ok {
+				return nil, fmt.Errorf("rpc: unsupported CBOR map key %v", key)
+			}
+			if items[name], err = d.decode(depth + 1); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	case majorTag:
+		// Tags are ignored, leaving the tagged item as is.
+		return d.decode(depth + 1)
+	}
+	switch info {
+	case 20:
+		return false, nil
+	case 21:
+		return true, nil
+	case 22, 23:
+		return nil, nil
+	case 25:
+		return halfToFloat(uint16(n)), nil
+	case 26:
+		return float64(math.Float32frombits(uint32(n))), nil
+	case 27:
+		return math.Float64frombits(n), nil
+	}
+	return nil, fmt.Errorf("rpc: unsupported CBOR simple value %d", info)
+}
+
+// head reads the initial bytes of an item, returning its major type, its
+// additional info and its argument.
+func (d *decoder) head() (major, info byte, n uint64, err error) {
+	if d.off >= len(d.data) {
+		return 0, 0, 0, errTruncated
+	}
+	b := d.data[d.off]
+	d.off++
+	major, info = b>>5, b&0x1f
+	switch {
+	case info < 24:
+		return major, info, uint64(info), nil
+	case info <= 27:
+		size := 1 << (info - 24)
+		arg, err := d.bytes(uint64(size))
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		for _, c := range arg {
+			n = n<<8 | uint64(c)
+		}
+		return major, info, n, nil
+	}
+	return 0, 0, 0, errors.New("rpc: unsupported CBOR indefinite length item")
+}
+
+// bytes reads the next n bytes.
+func (d *decoder) bytes(n uint64) ([]byte, error) {
+	if n > uint64(len(d.data)-d.off) {
+		return nil, errTruncated
+	}
+	b := d.data[d.off : d.off+int(n)]
+	d.off += int(n)
+	return b, nil
+}
+
+// halfToFloat converts an IEEE 754 half precision number.
+func halfToFloat(h uint16) float64 {
+	exp := int(h>>10) & 0x1f
+	mant := float64(h & 0x3ff)
+	var f float64
+	switch exp {
+	case 0:
+		f = math.Ldexp(mant, -24)
+	case 31:
+		if mant == 0 {
+			f = math.Inf(1)
+		} else {
+			f = math.NaN()
+		}
+	default:
+		f = math.Ldexp(mant+1024, exp-25)
+	}
+	if h&0x8000 != 0 {
+		f = -f
+	}
+	return f
+}
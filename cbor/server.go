@@ -0,0 +1,161 @@
+// Copyright 2013 X-Formation. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cbor
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/x-formation/rpc"
+)
+
+// MethodHeader is the request header which may carry the RPC method, instead
+// of the request envelope.
+const MethodHeader = "X-RPC-Method"
+
+// ErrEmptyBody is returned when a request is sent without a body.
+var ErrEmptyBody = errors.New("rpc: empty request body")
+
+// ----------------------------------------------------------------------------
+// Request and Response
+// ----------------------------------------------------------------------------
+
+// serverRequest represents a request received by the server.
+type serverRequest struct {
+	// The name of the method to be invoked, unless set in the MethodHeader.
+	Method string
+	// The args of the method, as a generic value until their type is known.
+	Params interface{}
+	// The request id, used to match the response with the request.
+	Id interface{}
+}
+
+// serverResponse represents a response returned by the server.
+type serverResponse struct {
+	// The Object that was returned by the invoked method. This must be null
+	// in case there was an error invoking the method.
+	Result interface{} `json:"result"`
+	// The error message if there was an error invoking the method. It must
+	// be null if there was no error.
+	Error interface{} `json:"error"`
+	// This must be the same id as the request it is responding to.
+	Id interface{} `json:"id"`
+}
+
+// ----------------------------------------------------------------------------
+// Codec
+// ----------------------------------------------------------------------------
+
+// NewCodec returns a new CBOR Codec.
+func NewCodec() *Codec {
+	return &Codec{}
+}
+
+// Codec creates a CodecRequest to process each request.
+type Codec struct {
+}
+
+// NewRequest returns a CodecRequest.
+func (c *Codec) NewRequest(r *http.Request) rpc.CodecRequest {
+	return newCodecRequest(r)
+}
+
+// ----------------------------------------------------------------------------
+// CodecRequest
+// ----------------------------------------------------------------------------
+
+// newCodecRequest returns a new CodecRequest.
+func newCodecRequest(r *http.Request) rpc.CodecRequest {
+	req := new(serverRequest)
+	data, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	if err == nil {
+		if len(data) == 0 {
+			err = ErrEmptyBody
+		} else {
+			err = decodeRequest(data, req)
+		}
+	}
+	if method := r.Header.Get(MethodHeader); method != "" {
+		req.Method = method
+	}
+	return &CodecRequest{request: req, err: err}
+}
+
+// decodeRequest decodes the request envelope, a map holding the "method",
+// "params" and "id" keys.
+func decodeRequest(data []byte, req *serverRequest) error {
+	d := &decoder{data: data}
+	generic, err := d.decode(0)
+	if err != nil {
+		return err
+	}
+	envelope, ok := generic.(map[string]interface{})
+	if !ok || d.off != len(d.data) {
+		return errors.New("rpc: method request ill-formed: expected a CBOR map")
+	}
+	if method, ok := envelope["method"]; ok {
+		if req.Method, ok = method.(string); !ok {
+			return errors.New("rpc: method request ill-formed: method is not a string")
+		}
+	}
+	req.Params = envelope["params"]
+	req.Id = envelope["id"]
+	return nil
+}
+
+// CodecRequest decodes and encodes a single request.
+type CodecRequest struct {
+	request *serverRequest
+	err     error
+}
+
+// Method returns the RPC method for the current request.
+//
+// The method uses a dotted notation as in "Service.Method".
+func (c *CodecRequest) Method() (string, error) {
+	if c.err != nil {
+		return "", c.err
+	}
+	if c.request.Method == "" {
+		return "", errors.New("rpc: method request ill-formed: missing method")
+	}
+	return c.request.Method, nil
+}
+
+// ReadRequest fills the request object for the RPC method.
+func (c *CodecRequest) ReadRequest(args interface{}) error {
+	if c.err == nil {
+		if c.request.Params != nil {
+			c.err = fromGeneric(c.request.Params, args)
+		} else {
+			c.err = errors.New("rpc: method request ill-formed: missing params field")
+		}
+	}
+	return c.err
+}
+
+// WriteResponse encodes the response and writes it to the ResponseWriter.
+//
+// The err parameter is the error resulted from calling the RPC method,
+// or nil if there was no error.
+func (c *CodecRequest) WriteResponse(w http.ResponseWriter, reply interface{}, methodErr error) error {
+	if c.err != nil {
+		return c.err
+	}
+	res := &serverResponse{Result: reply, Id: c.request.Id}
+	if methodErr != nil {
+		res.Result = nil
+		res.Error = methodErr.Error()
+	}
+	data, err := marshal(res)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/cbor")
+	_, err = w.Write(data)
+	return err
+}
@@ -0,0 +1,122 @@
+// Copyright 2013 X-Formation. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"net/http"
+)
+
+// RequestIDHeader is the header carrying the id of a request, read from the
+// request and echoed in the response when SetRequestID is on.
+const RequestIDHeader = "X-Request-Id"
+
+// CallInfo describes the method call a request is served by.
+type CallInfo struct {
+	// Called method, in dotted notation as in "Service.Method".
+	Method string
+	// Name of the called service, as registered.
+	Service string
+	// IP address of the client, or nil if it cannot be read. It is read
+	// from the X-Forwarded-For header of requests from the proxies trusted
+	// with TrustForwardedFor.
+	RemoteIP net.IP
+	// Content type of the request, which selected the codec.
+	ContentType string
+	// Id of the request, if SetRequestID is on.
+	RequestID string
+}
+
+// callInfoKey is the context key of the CallInfo.
+type callInfoKey struct{}
+
+// SetCallInfo makes the server store a CallInfo in the context of the
+// requests passed to methods, which they can read with FromContext.
+func (s *Server) SetCallInfo(on bool) {
+	s.callInfo = on
+}
+
+// FromContext returns the CallInfo stored in the context of a request by a
+// server whose SetCallInfo is on.
+func FromContext(ctx context.Context) (*CallInfo, bool) {
+	info, ok := ctx.Value(callInfoKey{}).(*CallInfo)
+	return info, ok
+}
+
+// requestedMethodKey is the context key of the method requested of a
+// fallback method.
+type requestedMethodKey struct{}
+
+// RequestedMethod returns the method name requested by the client, when
+// called from the method set with SetFallbackMethod. It returns an empty
+// string for requests to registered methods.
+func RequestedMethod(ctx context.Context) string {
+	method, _ := ctx.Value(requestedMethodKey{}).(string)
+	return method
+}
+
+// withRequestedMethod returns the request with the requested method name in
+// its context.
+func withRequestedMethod(r *http.Request, method string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), requestedMethodKey{}, method))
+}
+
+// withCallInfo returns the request with the CallInfo in its context.
+func withCallInfo(r *http.Request, info *CallInfo) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), callInfoKey{}, info))
+}
+
+// requestIDKey is the context key of the request id.
+type requestIDKey struct{}
+
+// SetRequestID makes the server assign an id to every request, read from
+// its RequestIDHeader or generated if absent or invalid. The id is set in the
+// RequestIDHeader of the response, logged, and stored in the request context
+// where methods and hooks can read it with RequestID.
+func (s *Server) SetRequestID(on bool) {
+	s.reqID = on
+}
+
+// RequestID returns the id assigned to a request by a server whose
+// SetRequestID is on, or an empty string.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// withRequestID returns the request with the id read from its header or
+// generated in its context.
+func withRequestID(r *http.Request) (*http.Request, string) {
+	id := r.Header.Get(RequestIDHeader)
+	if !validRequestID(id) {
+		id = newRequestID()
+	}
+	return r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)), id
+}
+
+// validRequestID returns true if a request id read from a header is not
+// empty, reasonably short and made of printable ASCII characters, so it can
+// safely be logged.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID returns a random request id.
+func newRequestID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
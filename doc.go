@@ -72,7 +72,36 @@ and make available the ones that follow these rules:
 	- The second and third arguments are exported or local.
 	- The method has return type error.
 
-All other methods are ignored.
+The args and reply may point to structs as well as to slices or maps, as in
+*[]int or *map[string]int.
+
+Alternatively, a method may omit the *reply argument and return the reply
+along with the error:
+
+	func (h *HelloService) Greet(r *http.Request, args *HelloArgs) (HelloReply, error) {
+		return HelloReply{Message: "Hello, " + args.Who + "!"}, nil
+	}
+
+Long-running methods may stream incremental results by taking an rpc.Stream
+in place of the *reply argument, provided the codec supports streaming:
+
+	func (h *HelloService) Count(r *http.Request, args *int, stream rpc.Stream) error {
+		for i := 1; i <= *args; i++ {
+			if err := stream.Send(i); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+All other methods are ignored, except near misses: methods taking an
+*http.Request first, with the arguments and results of one of the forms
+above, but whose args or reply is not a pointer. Registering a service with
+such a method fails, naming the method, rather than leaving it out.
+
+The server also registers its own methods under the reserved "rpc" service
+name. Calling "rpc.listMethods" returns the names of all registered methods
+along with the JSON encoded zero values of their args and reply types.
 
 Gorilla has packages with common RPC codecs. Check out their documentation:
 
@@ -0,0 +1,42 @@
+// Copyright 2013 X-Formation. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+Package form provides a codec for RPC over HTTP services called from plain
+HTML forms.
+
+To register the codec in a RPC server:
+
+	import (
+		"http"
+		"github.com/x-formation/rpc"
+		"github.com/x-formation/rpc/form"
+	)
+
+	func init() {
+		s := rpc.NewServer()
+		s.RegisterCodec(form.NewCodec(), "application/x-www-form-urlencoded")
+		// [...]
+		http.Handle("/rpc", s)
+	}
+
+Request format is an urlencoded form, as sent by browsers:
+
+	method:
+		The name of the method to be invoked, as a string in dotted notation
+		as in "Service.Method".
+
+All other fields are assigned to the fields of the same name of the method
+args, converting their values to booleans or numbers where needed.
+
+Response format is a JSON object:
+
+	result:
+		The Object that was returned by the invoked method,
+		or null in case there was an error invoking the method.
+	error:
+		The error message if there was an error invoking the method,
+		or null if there was no error.
+*/
+package form
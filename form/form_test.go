@@ -0,0 +1,79 @@
+// Copyright 2013 X-Formation. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package form
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/x-formation/rpc"
+)
+
+var ErrResponseError = errors.New("response error")
+
+type Service1Request struct {
+	A      int
+	B      int
+	Negate bool
+}
+
+type Service1Response struct {
+	Result int
+}
+
+type Service1 struct {
+}
+
+func (t *Service1) Multiply(r *http.Request, req *Service1Request, res *Service1Response) error {
+	res.Result = req.A * req.B
+	if req.Negate {
+		res.Result = -res.Result
+	}
+	return nil
+}
+
+func (t *Service1) ResponseError(r *http.Request, req *Service1Request, res *Service1Response) error {
+	return ErrResponseError
+}
+
+func execute(t *testing.T, s *rpc.Server, form url.Values) (int, map[string]interface{}) {
+	r, _ := http.NewRequest("POST", "http://localhost:8080/", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+
+	var res map[string]interface{}
+	json.NewDecoder(w.Body).Decode(&res)
+	return w.Code, res
+}
+
+func TestService(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/x-www-form-urlencoded")
+	s.RegisterService(new(Service1), "")
+
+	code, res := execute(t, s, url.Values{"method": {"Service1.Multiply"}, "a": {"4"}, "B": {"2"}, "negate": {"true"}})
+	if code != 200 {
+		t.Errorf("Expected http response code 200, but got %v", code)
+	}
+	if result, ok := res["result"].(map[string]interface{}); !ok || result["Result"] != float64(-8) {
+		t.Errorf("Wrong response: %v.", res)
+	}
+	if _, res = execute(t, s, url.Values{"method": {"Service1.ResponseError"}}); res["error"] != ErrResponseError.Error() {
+		t.Errorf("Expected to get %q, but got %v", ErrResponseError, res["error"])
+	}
+	if code, _ = execute(t, s, url.Values{"method": {"Service1.Multiply"}, "A": {"four"}}); code != 400 {
+		t.Errorf("Expected http response code 400, but got %v", code)
+	}
+	if code, _ = execute(t, s, url.Values{"A": {"4"}}); code != 400 {
+		t.Errorf("Expected http response code 400, but got %v", code)
+	}
+}
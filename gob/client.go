@@ -0,0 +1,39 @@
+// Copyright 2013 X-Formation. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gob
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"io"
+)
+
+// EncodeClientRequest encodes parameters for a gob client request.
+func EncodeClientRequest(method string, args interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := gob.NewEncoder(&buf)
+	if err := encoder.Encode(&requestHeader{Method: method}); err != nil {
+		return nil, err
+	}
+	if err := encoder.Encode(args); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// DecodeClientResponse decodes the response body of a client request into
+// the interface reply.
+func DecodeClientResponse(r io.Reader, reply interface{}) error {
+	decoder := gob.NewDecoder(r)
+	var header responseHeader
+	if err := decoder.Decode(&header); err != nil {
+		return err
+	}
+	if header.Error != "" {
+		return errors.New(header.Error)
+	}
+	return decoder.Decode(reply)
+}
@@ -0,0 +1,41 @@
+// Copyright 2013 X-Formation. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+Package gob provides a codec for RPC over HTTP services between Go programs,
+using the encoding/gob package.
+
+To register the codec in a RPC server:
+
+	import (
+		"http"
+		"github.com/x-formation/rpc"
+		"github.com/x-formation/rpc/gob"
+	)
+
+	func init() {
+		s := rpc.NewServer()
+		s.RegisterCodec(gob.NewCodec(), "application/x-gob")
+		// [...]
+		http.Handle("/rpc", s)
+	}
+
+Request body is a gob stream of two values:
+
+	header:
+		A struct with a Method field holding the name of the method to be
+		invoked, as a string in dotted notation as in "Service.Method". The
+		method may be left empty and sent in the X-RPC-Method header
+		instead.
+	args:
+		The args of the method.
+
+Response body is a gob stream of a header struct, whose Error field holds the
+error message if there was an error invoking the method, followed by the reply
+of the method if there was no error.
+
+Use EncodeClientRequest and DecodeClientResponse to write requests and read
+responses.
+*/
+package gob
@@ -0,0 +1,90 @@
+// Copyright 2013 X-Formation. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gob
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/x-formation/rpc"
+)
+
+var ErrResponseError = errors.New("response error")
+
+type Service1Request struct {
+	A int
+	B int
+}
+
+type Service1Response struct {
+	Result int
+}
+
+type Service1 struct {
+}
+
+func (t *Service1) Multiply(r *http.Request, req *Service1Request, res *Service1Response) error {
+	res.Result = req.A * req.B
+	return nil
+}
+
+func (t *Service1) ResponseError(r *http.Request, req *Service1Request, res *Service1Response) error {
+	return ErrResponseError
+}
+
+func execute(t *testing.T, s *rpc.Server, method string, req, res interface{}) error {
+	buf, err := EncodeClientRequest(method, req)
+	if err != nil {
+		t.Fatal("Expected nil err, but got", err)
+	}
+	r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewReader(buf))
+	r.Header.Set("Content-Type", "application/x-gob")
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+
+	if ct := w.Header().Get("Content-Type"); ct != "application/x-gob" {
+		t.Errorf("Expected application/x-gob Content-Type, but got %q", ct)
+	}
+	return DecodeClientResponse(w.Body, res)
+}
+
+func TestService(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/x-gob")
+	s.RegisterService(new(Service1), "")
+
+	var res Service1Response
+	if err := execute(t, s, "Service1.Multiply", &Service1Request{4, -2}, &res); err != nil {
+		t.Error("Expected err to be nil, but got", err)
+	}
+	if res.Result != -8 {
+		t.Errorf("Wrong response: %v.", res.Result)
+	}
+	if err := execute(t, s, "Service1.ResponseError", &Service1Request{}, &res); err == nil || err.Error() != ErrResponseError.Error() {
+		t.Errorf("Expected to get %q, but got %v", ErrResponseError, err)
+	}
+}
+
+func TestMethodHeader(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/x-gob")
+	s.RegisterService(new(Service1), "")
+
+	buf, _ := EncodeClientRequest("", &Service1Request{3, 5})
+	r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewReader(buf))
+	r.Header.Set("Content-Type", "application/x-gob")
+	r.Header.Set(MethodHeader, "Service1.Multiply")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+
+	var res Service1Response
+	if err := DecodeClientResponse(w.Body, &res); err != nil || res.Result != 15 {
+		t.Errorf("Expected 15 with nil err, but got %v (%v)", res.Result, err)
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2013 X-Formation. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gob
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/x-formation/rpc"
+)
+
+// MethodHeader is the request header which may carry the RPC method, instead
+// of the request body.
+const MethodHeader = "X-RPC-Method"
+
+// ErrEmptyBody is returned when a request is sent without a body.
+var ErrEmptyBody = errors.New("rpc: empty request body")
+
+// ----------------------------------------------------------------------------
+// Request and Response
+// ----------------------------------------------------------------------------
+
+// requestHeader precedes the args in a request body.
+type requestHeader struct {
+	// The name of the method to be invoked, unless set in the MethodHeader.
+	Method string
+}
+
+// responseHeader precedes the reply in a response body.
+type responseHeader struct {
+	// The error message if there was an error invoking the method, in which
+	// case no reply follows.
+	Error string
+}
+
+// ----------------------------------------------------------------------------
+// Codec
+// ----------------------------------------------------------------------------
+
+// NewCodec returns a new gob Codec.
+func NewCodec() *Codec {
+	return &Codec{}
+}
+
+// Codec creates a CodecRequest to process each request.
+type Codec struct {
+}
+
+// NewRequest returns a CodecRequest.
+func (c *Codec) NewRequest(r *http.Request) rpc.CodecRequest {
+	return newCodecRequest(r)
+}
+
+// ----------------------------------------------------------------------------
+// CodecRequest
+// ----------------------------------------------------------------------------
+
+// newCodecRequest returns a new CodecRequest.
+func newCodecRequest(r *http.Request) rpc.CodecRequest {
+	decoder := gob.NewDecoder(r.Body)
+	var header requestHeader
+	err := decoder.Decode(&header)
+	if err == io.EOF {
+		err = ErrEmptyBody
+	}
+	if method := r.Header.Get(MethodHeader); method != "" {
+		header.Method = method
+	}
+	return &CodecRequest{method: header.Method, decoder: decoder, body: r.Body, err: err}
+}
+
+// CodecRequest decodes and encodes a single request.
+type CodecRequest struct {
+	method  string
+	decoder *gob.Decoder
+	body    io.Closer
+	err     error
+}
+
+// Method returns the RPC method for the current request.
+//
+// The method uses a dotted notation as in "Service.Method".
+func (c *CodecRequest) Method() (string, error) {
+	if c.err != nil {
+		return "", c.err
+	}
+	if c.method == "" {
+		return "", errors.New("rpc: method request ill-formed: missing method")
+	}
+	return c.method, nil
+}
+
+// ReadRequest fills the request object for the RPC method.
+func (c *CodecRequest) ReadRequest(args interface{}) error {
+	if c.err == nil {
+		c.err = c.decoder.Decode(args)
+		c.body.Close()
+	}
+	return c.err
+}
+
+// WriteResponse encodes the response and writes it to the ResponseWriter.
+//
+// The err parameter is the error resulted from calling the RPC method,
+// or nil if there was no error.
+func (c *CodecRequest) WriteResponse(w http.ResponseWriter, reply interface{}, methodErr error) error {
+	if c.err != nil {
+		return c.err
+	}
+	// Encode to a buffer first, so that encoding errors can still be
+	// reported by the server.
+	var buf bytes.Buffer
+	encoder := gob.NewEncoder(&buf)
+	if methodErr != nil {
+		if err := encoder.Encode(&responseHeader{Error: methodErr.Error()}); err != nil {
+			return err
+		}
+	} else {
+		if err := encoder.Encode(&responseHeader{}); err != nil {
+			return err
+		}
+		if err := encoder.Encode(reply); err != nil {
+			return err
+		}
+	}
+	w.Header().Set("Content-Type", "application/x-gob")
+	_, err := w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,137 @@
+// Copyright 2013 X-Formation. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// SetGzipMinSize makes the server compress with gzip the responses longer
+// than n bytes, for clients accepting the gzip content encoding. Shorter
+// responses are sent uncompressed. A negative value, the default, disables
+// compression.
+//
+// Streamed responses are never compressed.
+func (s *Server) SetGzipMinSize(n int) {
+	s.gzipMin = n
+}
+
+// SetSniffEncoding makes the server decompress the request bodies starting
+// with the gzip magic number, whatever their Content-Encoding header, for
+// clients sending gzip bodies without declaring them. Other bodies are read
+// unchanged. It is disabled by default.
+func (s *Server) SetSniffEncoding(sniff bool) {
+	s.sniff = sniff
+}
+
+// sniffReader decompresses a request body if it starts with the gzip magic
+// number, which is looked for on the first read.
+type sniffReader struct {
+	io.ReadCloser
+	r io.Reader
+}
+
+func (b *sniffReader) Read(p []byte) (int, error) {
+	if b.r == nil {
+		br := bufio.NewReader(b.ReadCloser)
+		b.r = br
+		if magic, _ := br.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+			gz, err := gzip.NewReader(br)
+			if err != nil {
+				return 0, err
+			}
+			b.r = gz
+		}
+	}
+	return b.r.Read(p)
+}
+
+// writeReply writes the response for the method reply, compressing it if
+// the server and the client allow it.
+func (s *Server) writeReply(w *responseWriter, r *http.Request, codecReq CodecRequest, reply interface{}, errResult error) (err error) {
+	var out http.ResponseWriter = w
+	var buf *bufferedWriter
+	if s.gzipMin >= 0 && acceptsGzip(r) {
+		buf = &bufferedWriter{responseWriter: w}
+		out = buf
+	}
+	if raw, ok := reply.(RawResponder); ok && errResult == nil {
+		err = writeRaw(out, raw)
+	} else {
+		err = codecReq.WriteResponse(out, reply, errResult)
+	}
+	if err == nil && buf != nil {
+		err = buf.flush(s.gzipMin)
+	}
+	return
+}
+
+// acceptsGzip returns true if the request accepts the gzip content encoding
+// with a non-zero quality.
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		params := strings.Split(enc, ";")
+		if !strings.EqualFold(strings.TrimSpace(params[0]), "gzip") {
+			continue
+		}
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(param[2:], 64)
+				return err == nil && q > 0
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// bufferedWriter holds back a response body until its length is known.
+type bufferedWriter struct {
+	*responseWriter
+	buf bytes.Buffer
+}
+
+// WriteHeader records the status, to be sent with the body.
+func (w *bufferedWriter) WriteHeader(status int) {
+	w.status = status
+}
+
+// Write buffers the response body.
+func (w *bufferedWriter) Write(b []byte) (int, error) {
+	return w.buf.Write(b)
+}
+
+// Flush does nothing, as the body is sent once complete.
+func (w *bufferedWriter) Flush() {
+}
+
+// flush sends the buffered body, compressed if longer than min bytes.
+func (w *bufferedWriter) flush(min int) error {
+	if w.buf.Len() <= min {
+		_, err := w.responseWriter.Write(w.buf.Bytes())
+		return err
+	}
+	if rec, ok := w.ResponseWriter.(*recordingWriter); ok {
+		// Cached responses are replayed to requests which may not
+		// accept gzip.
+		rec.plain = w.buf.Bytes()
+	}
+	h := w.Header()
+	h.Set("Content-Encoding", "gzip")
+	h.Add("Vary", "Accept-Encoding")
+	h.Del("Content-Length")
+	gz := gzip.NewWriter(w.responseWriter)
+	if _, err := gz.Write(w.buf.Bytes()); err != nil {
+		return err
+	}
+	return gz.Close()
+}
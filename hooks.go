@@ -0,0 +1,124 @@
+// Copyright 2013 X-Formation. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"net/http"
+	"reflect"
+)
+
+// RequestInfo describes a method call, as seen by the functions registered
+// with RegisterBeforeFunc and RegisterAfterFunc.
+type RequestInfo struct {
+	// Name of the called service, as registered.
+	Service string
+	// Called method, in dotted notation as in "Service.Method".
+	Method string
+	// Receiver of the service methods, or the zero Value for services
+	// made of standalone functions.
+	Receiver reflect.Value
+	// The request being served.
+	Request *http.Request
+	// Error which caused the request to fail, or the error returned by the
+	// method call. Only set for after functions.
+	Error error
+	// HTTP status of the response. Only set for after functions.
+	StatusCode int
+	// Id of the request, if SetRequestID is on.
+	RequestID string
+	// Copy of the decoded method args, a pointer, or the zero Value if they
+	// were not decoded, or if the method call timed out and still runs.
+	// Changing it does not change the args passed to the method, except
+	// through unexported fields holding references.
+	Args reflect.Value
+}
+
+// RegisterBeforeFunc registers a function called before each method call,
+// once the args were decoded. If the function returns an error, the method
+// is not called and the server responds with a 403.
+func (s *Server) RegisterBeforeFunc(f func(i *RequestInfo) error) {
+	s.before = append(s.before, f)
+}
+
+// RegisterAfterFunc registers a function called once a request to a
+// registered method was served, whether or not the method was called.
+func (s *Server) RegisterAfterFunc(f func(i *RequestInfo)) {
+	s.after = append(s.after, f)
+}
+
+// info returns the RequestInfo of a request whose service was resolved.
+func (state *requestState) info(r *http.Request) *RequestInfo {
+	return &RequestInfo{
+		Service:   state.service.name,
+		Method:    state.method,
+		Receiver:  state.service.rcvr,
+		Request:   r,
+		RequestID: RequestID(r.Context()),
+		Args:      copyValue(state.args),
+	}
+}
+
+// copyValue returns a deep copy of a value, following pointers, slices, maps
+// and interfaces. Unexported struct fields are copied shallowly. The value
+// must not hold reference cycles.
+func copyValue(v reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.New(v.Type().Elem())
+		c.Elem().Set(copyValue(v.Elem()))
+		return c
+	case reflect.Interface:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.New(v.Type()).Elem()
+		c.Set(copyValue(v.Elem()))
+		return c
+	case reflect.Struct:
+		c := reflect.New(v.Type()).Elem()
+		c.Set(v)
+		for i := 0; i < v.NumField(); i++ {
+			if c.Field(i).CanSet() {
+				c.Field(i).Set(copyValue(v.Field(i)))
+			}
+		}
+		return c
+	case reflect.Array:
+		c := reflect.New(v.Type()).Elem()
+		for i := 0; i < v.Len(); i++ {
+			c.Index(i).Set(copyValue(v.Index(i)))
+		}
+		return c
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			c.Index(i).Set(copyValue(v.Index(i)))
+		}
+		return c
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.MakeMap(v.Type())
+		for _, key := range v.MapKeys() {
+			c.SetMapIndex(key, copyValue(v.MapIndex(key)))
+		}
+		return c
+	}
+	return v
+}
+
+// SetCancelFunc registers a function called when the client cancels a
+// request, e.g. by disconnecting, while its method is being called. No
+// response is written for canceled requests.
+func (s *Server) SetCancelFunc(f func(i *RequestInfo)) {
+	s.canceled = f
+}
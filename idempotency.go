@@ -0,0 +1,213 @@
+// Copyright 2013 X-Formation. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// IdempotencyKeyHeader is the request header a client may set to a unique
+// key, reused when retrying the request, for the server to respond to the
+// retries with the response already sent.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// EnableIdempotency makes the server cache, for the given duration, the
+// responses to requests with an IdempotencyKeyHeader. Requests repeating a
+// key get the cached response, without calling the method again, or a 409
+// if the first request with the key is still being served. Responses with a
+// 5xx status are not cached, so that such requests can be retried. A zero
+// duration disables the cache.
+//
+// Keys are scoped by client IP, method and request body: a request only
+// gets the response cached for a request of the same client, to the same
+// method and with the same body. Cached responses are only sent to requests
+// accepted by the server, once the method was resolved as for any request.
+// The bodies of requests with a key are read in memory to be hashed, and
+// cached responses are replayed with the request id and the compression
+// negotiated by the retry.
+func (s *Server) EnableIdempotency(ttl time.Duration) {
+	if ttl > 0 {
+		s.idem = &idempotencyStore{ttl: ttl, responses: make(map[string]*cachedResponse)}
+	} else {
+		s.idem = nil
+	}
+}
+
+// hashBody reads the body of a request with an idempotency key in memory,
+// for the request to be read again, and returns its hash.
+func hashBody(r *http.Request) (string, error) {
+	var body []byte
+	if r.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			return "", err
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// idempotencyKey returns the key caching the response to a request, scoped
+// by the client IP, the method and the hash of the request body.
+func idempotencyKey(r *http.Request, state *requestState, digest string) string {
+	client := r.RemoteAddr
+	if state.ip != nil {
+		client = state.ip.String()
+	}
+	return client + " " + state.method + " " + digest + " " + r.Header.Get(IdempotencyKeyHeader)
+}
+
+// finishOnce caches the response to a request once it is served, unless it
+// failed with a 5xx or its client went away.
+func (s *Server) finishOnce(w *responseWriter, key string, rec *recordingWriter, err error) {
+	if !w.wroteHeader && err != context.Canceled {
+		w.WriteHeader(w.Status())
+	}
+	if err == context.Canceled || w.Status() >= 500 {
+		s.idem.forget(key)
+	} else {
+		s.idem.finish(key, rec)
+	}
+}
+
+// idempotencyStore caches the responses to requests by idempotency key.
+type idempotencyStore struct {
+	mutex     sync.Mutex
+	ttl       time.Duration
+	responses map[string]*cachedResponse
+	purged    time.Time // last time expired responses were removed
+}
+
+// cachedResponse is a response cached by idempotency key.
+type cachedResponse struct {
+	done    bool // whether the request was served
+	expires time.Time
+	status  int
+	header  http.Header
+	body    []byte // uncompressed body
+	gzipped bool   // whether the body was sent compressed
+}
+
+// start returns the cached response for a key, or nil if the key is new, in
+// which case the caller must serve the request then call finish or forget.
+// It returns false if a request with the same key is being served.
+func (c *idempotencyStore) start(key string) (*cachedResponse, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	now := time.Now()
+	if now.Sub(c.purged) > c.ttl {
+		for k, res := range c.responses {
+			if res.done && now.After(res.expires) {
+				delete(c.responses, k)
+			}
+		}
+		c.purged = now
+	}
+	if res, ok := c.responses[key]; ok && !(res.done && now.After(res.expires)) {
+		if !res.done {
+			return nil, false
+		}
+		return res, true
+	}
+	c.responses[key] = &cachedResponse{}
+	return nil, true
+}
+
+// finish caches the response recorded for a key, without its request id
+// and its compression, which depend on the request.
+func (c *idempotencyStore) finish(key string, rec *recordingWriter) {
+	header := make(http.Header, len(rec.Header()))
+	for k, v := range rec.Header() {
+		header[k] = append([]string(nil), v...)
+	}
+	header.Del(RequestIDHeader)
+	body := rec.body.Bytes()
+	if rec.plain != nil {
+		body = rec.plain
+		header.Del("Content-Encoding")
+		if vary := header["Vary"]; len(vary) > 0 && vary[len(vary)-1] == "Accept-Encoding" {
+			header["Vary"] = vary[:len(vary)-1]
+		}
+		if len(header["Vary"]) == 0 {
+			header.Del("Vary")
+		}
+	}
+	c.mutex.Lock()
+	c.responses[key] = &cachedResponse{
+		done:    true,
+		expires: time.Now().Add(c.ttl),
+		status:  rec.status,
+		header:  header,
+		body:    body,
+		gzipped: rec.plain != nil,
+	}
+	c.mutex.Unlock()
+}
+
+// forget removes a key whose response is not cached.
+func (c *idempotencyStore) forget(key string) {
+	c.mutex.Lock()
+	delete(c.responses, key)
+	c.mutex.Unlock()
+}
+
+// replay writes a cached response, compressed again if it was and the
+// request accepts it.
+func (s *Server) replay(w *responseWriter, r *http.Request, res *cachedResponse) error {
+	for k, v := range res.header {
+		w.Header()[k] = append([]string(nil), v...)
+	}
+	if res.gzipped && s.gzipMin >= 0 && acceptsGzip(r) {
+		buf := &bufferedWriter{responseWriter: w}
+		buf.WriteHeader(res.status)
+		buf.Write(res.body)
+		return buf.flush(s.gzipMin)
+	}
+	w.WriteHeader(res.status)
+	_, err := w.Write(res.body)
+	return err
+}
+
+// recordingWriter keeps a copy of the response it writes.
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+	plain  []byte // body before compression, if compressed
+}
+
+func (w *recordingWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = 200
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.body.Write(b[:n])
+	return n, err
+}
+
+// Flush sends any buffered data to the client, if supported by the
+// underlying http.ResponseWriter.
+func (w *recordingWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
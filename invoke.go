@@ -0,0 +1,66 @@
+// Copyright 2013 X-Formation. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// Invoke calls a registered method in-process, without encoding a request
+// or a response, and returns the method reply and error, e.g. to unit test
+// services without building HTTP requests:
+//
+//    reply, err := s.Invoke("Service.Method", &Args{A: 4, B: 2})
+//
+// The args are the method args type, or a pointer to it. As with a request,
+// the args are checked for their required fields, and validated if they
+// implement Validator, but neither the client restrictions nor the before
+// and after functions apply. The method receives an empty POST request.
+// Methods writing their own response, or streaming it, cannot be invoked.
+//
+// The method uses a dotted notation as in "Service.Method".
+func (s *Server) Invoke(method string, args interface{}) (interface{}, error) {
+	serviceSpec, methodSpec, err := s.services.get(method)
+	if err != nil {
+		return nil, err
+	}
+	if methodSpec.streams || methodSpec.writes {
+		return nil, errors.New("rpc: method " + method + " writes its response and cannot be invoked")
+	}
+	argsValue := reflect.ValueOf(args)
+	switch {
+	case argsValue.IsValid() && argsValue.Type() == reflect.PtrTo(methodSpec.argsType):
+		if argsValue.IsNil() {
+			return nil, errors.New("rpc: nil args invoking " + method)
+		}
+	case argsValue.IsValid() && argsValue.Type() == methodSpec.argsType:
+		ptr := reflect.New(methodSpec.argsType)
+		ptr.Elem().Set(argsValue)
+		argsValue = ptr
+	default:
+		return nil, errors.New("rpc: args of type " + methodSpec.argsType.String() + " required invoking " + method)
+	}
+	if missing := methodSpec.missing(argsValue); len(missing) > 0 {
+		return nil, errors.New("rpc: missing required fields: " + strings.Join(missing, ", "))
+	}
+	if v, ok := argsValue.Interface().(Validator); ok {
+		if err := v.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	r, err := http.NewRequest("POST", "/", http.NoBody)
+	if err != nil {
+		return nil, err
+	}
+	var reply reflect.Value
+	if !methodSpec.returnsReply {
+		reply = reflect.New(methodSpec.replyType)
+	}
+	reply, err, _ = s.call(r, nil, serviceSpec, methodSpec, argsValue, reply)
+	return reply.Interface(), err
+}
@@ -0,0 +1,77 @@
+// Copyright 2013 X-Formation. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+	"unicode/utf16"
+)
+
+// charset returns the charset parameter of the request Content-Type, lower
+// cased, or an empty string if there is none.
+func charset(r *http.Request) string {
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(params["charset"])
+}
+
+// decodeCharset returns a reader of the body transcoded from the charset to
+// UTF-8. Supported charsets are UTF-8, UTF-16 and ISO-8859-1.
+func decodeCharset(body io.Reader, charset string) (io.Reader, error) {
+	switch charset {
+	case "", "utf-8", "utf8":
+		return body, nil
+	case "utf-16", "utf-16be", "utf-16le":
+		b, err := ioutil.ReadAll(body)
+		if err != nil {
+			return nil, err
+		}
+		return decodeUTF16(b, charset)
+	case "iso-8859-1", "latin1":
+		b, err := ioutil.ReadAll(body)
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		for _, c := range b {
+			buf.WriteRune(rune(c))
+		}
+		return &buf, nil
+	}
+	return nil, fmt.Errorf("rpc: unsupported charset %q", charset)
+}
+
+// decodeUTF16 transcodes UTF-16 text to UTF-8. Text in plain "utf-16" is big
+// endian unless it starts with a little endian byte order mark.
+func decodeUTF16(b []byte, charset string) (io.Reader, error) {
+	if len(b)%2 != 0 {
+		return nil, fmt.Errorf("rpc: invalid %s text: odd length", charset)
+	}
+	little := charset == "utf-16le"
+	if charset == "utf-16" && len(b) >= 2 && b[0] == 0xff && b[1] == 0xfe {
+		little = true
+	}
+	units := make([]uint16, len(b)/2)
+	for i := range units {
+		if little {
+			units[i] = uint16(b[2*i]) | uint16(b[2*i+1])<<8
+		} else {
+			units[i] = uint16(b[2*i])<<8 | uint16(b[2*i+1])
+		}
+	}
+	if len(units) > 0 && units[0] == 0xfeff {
+		// Drop the byte order mark.
+		units = units[1:]
+	}
+	return strings.NewReader(string(utf16.Decode(units))), nil
+}
@@ -6,10 +6,14 @@
 package json
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
 	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
 )
 
 // ----------------------------------------------------------------------------
@@ -46,16 +50,153 @@ func EncodeClientRequest(method string, args interface{}) ([]byte, error) {
 
 // DecodeClientResponse decodes the response body of a client request into
 // the interface reply.
+//
+// Errors reported by the server are returned as *Error, whether the server
+// sent an error object or a plain message.
 func DecodeClientResponse(r io.Reader, reply interface{}) error {
 	var c clientResponse
 	if err := json.NewDecoder(r).Decode(&c); err != nil {
 		return err
 	}
+	e, err := c.decode(reply)
+	if e != nil {
+		return e
+	}
+	return err
+}
+
+// DecodeClientResponseBytes decodes the response body of a client request
+// into the interface reply, like DecodeClientResponse, but returns the error
+// reported by the server apart from the error failing the decoding, if any.
+func DecodeClientResponseBytes(b []byte, reply interface{}) (*Error, error) {
+	var c clientResponse
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, err
+	}
+	return c.decode(reply)
+}
+
+// DecodeClientResponse decodes the response body of a client request into
+// the interface reply, like the DecodeClientResponse function, but reading
+// the result and error members named by the codec ResultField and ErrorField
+// options, to call servers of other JSON-RPC dialects.
+func (c *Codec) DecodeClientResponse(r io.Reader, reply interface{}) error {
+	var members map[string]*json.RawMessage
+	if err := json.NewDecoder(r).Decode(&members); err != nil {
+		return err
+	}
+	res := clientResponse{Result: members[c.resultField()]}
+	if raw := members[c.errorField()]; raw != nil {
+		if err := json.Unmarshal(*raw, &res.Error); err != nil {
+			return err
+		}
+	}
+	e, err := res.decode(reply)
+	if e != nil {
+		return e
+	}
+	return err
+}
+
+// decode decodes the result into the interface reply, or returns the error
+// reported by the server.
+func (c *clientResponse) decode(reply interface{}) (*Error, error) {
 	if c.Error != nil {
 		if object, ok := c.Error.(map[string]interface{}); ok {
-			return NewErrorObject(object)
+			return NewErrorObject(object), nil
+		}
+		return newErrorMessage(fmt.Sprint(c.Error)), nil
+	}
+	if c.Result == nil {
+		return nil, nil
+	}
+	return nil, json.Unmarshal(*c.Result, reply)
+}
+
+// ----------------------------------------------------------------------------
+// Client
+// ----------------------------------------------------------------------------
+
+// NewClient returns a new Client calling the server at the given URL, using
+// the given http.Client, or http.DefaultClient if nil.
+func NewClient(url string, client *http.Client) *Client {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &Client{url: url, client: client, attempts: 1}
+}
+
+// Client calls the methods of a JSON-RPC server over HTTP.
+type Client struct {
+	url      string
+	client   *http.Client
+	attempts int
+	backoff  func(attempt int) time.Duration
+}
+
+// SetRetry makes the client retry failed calls, up to maxAttempts attempts in
+// total, waiting for the duration returned by backoff for the number of the
+// failed attempt, starting at 1, or for the Retry-After duration sent by the
+// server. A nil backoff retries immediately.
+//
+// Calls are retried on network errors or when the server responds with a
+// 502, 503 or 504 status, but not when the method returns an error. As a
+// failed call may have reached the method, only enable retries for clients
+// calling idempotent methods.
+func (c *Client) SetRetry(maxAttempts int, backoff func(attempt int) time.Duration) {
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	c.attempts = maxAttempts
+	c.backoff = backoff
+}
+
+// Call calls the method with the given args, decoding its result into reply.
+func (c *Client) Call(method string, args, reply interface{}) error {
+	body, err := EncodeClientRequest(method, args)
+	if err != nil {
+		return err
+	}
+	for attempt := 1; ; attempt++ {
+		retry, after, err := c.call(body, reply)
+		if !retry || attempt >= c.attempts {
+			return err
+		}
+		if after == 0 && c.backoff != nil {
+			after = c.backoff(attempt)
+		}
+		time.Sleep(after)
+	}
+}
+
+// call sends a single request, returning whether it may be retried and the
+// delay requested by the server before doing so, if any.
+func (c *Client) call(body []byte, reply interface{}) (retry bool, after time.Duration, err error) {
+	res, err := c.client.Post(c.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return true, 0, err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true, retryAfter(res.Header.Get("Retry-After")), fmt.Errorf("rpc: server responded %s", res.Status)
+	}
+	return false, 0, DecodeClientResponse(res.Body, reply)
+}
+
+// retryAfter parses a Retry-After header, given in seconds or as a date,
+// returning zero if it is absent or invalid.
+func retryAfter(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if s, err := strconv.Atoi(header); err == nil && s > 0 {
+		return time.Duration(s) * time.Second
+	}
+	if t, err := http.ParseTime(header); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
 		}
-		return fmt.Errorf("%v", c.Error)
 	}
-	return json.Unmarshal(*c.Result, reply)
+	return 0
 }
@@ -25,6 +25,10 @@ A codec is tied to a content type. In the example above, the server will use
 the JSON codec for requests with "application/json" as the value for the
 "Content-Type" header.
 
+Request bodies are read as UTF-8, unless the "Content-Type" header declares a
+UTF-16 or ISO-8859-1 charset, as in "application/json; charset=utf-16".
+Requests in other charsets are rejected.
+
 This package follows the JSON-RPC 1.0 specification:
 
 	http://json-rpc.org/wiki/specification
@@ -50,6 +54,32 @@ Response format is:
 		or null if there was no error.
 	id:
 		The same id as the request it is responding to.
+	warning:
+		An array of non-fatal warnings, only present when the method
+		succeeded with a reply implementing rpc.Warner.
+
+The result and error members may be renamed with the ResultField and
+ErrorField options of the Codec, whose DecodeClientResponse method reads
+responses with such names.
+
+Responses are indented for requests with the "X-Pretty: true" header, except
+the chunks of streamed responses.
+
+Streaming methods respond with one such response object per chunk sent,
+each followed by a newline, using the "application/x-ndjson" content type.
+
+Independent requests may be sent in a single body as a JSON text sequence
+(RFC 7464), using the "application/json-seq" content type, to a handler
+returned by NewSeqHandler. Their responses are sent in order as a JSON text
+sequence too.
+
+Requests rejected by the server, e.g. for not using the POST method, get a
+response object with null result and id, provided their "Content-Type" or
+"Accept" header names the JSON codec. The id is that of the request if it
+was rejected once decoded, e.g. for invalid params.
+
+Requests for methods which are not registered get a 404 response whose
+error is an object with the -32601 code of JSON-RPC 2.0, and a message.
 
 Check the gorilla/rpc documentation for more details:
 
@@ -9,6 +9,7 @@ package json
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 )
 
 // Error allows for passing an JSON object to an error field
@@ -50,6 +51,16 @@ func NewErrorObject(object map[string]interface{}) (e *Error) {
 	return
 }
 
+// newErrorMessage creates an Error for a plain error message, as sent by
+// servers for errors which are not objects. Its Error method returns the
+// message itself.
+func newErrorMessage(msg string) *Error {
+	return &Error{
+		object: map[string]interface{}{"message": msg},
+		blob:   json.RawMessage(msg),
+	}
+}
+
 // Error
 func (e Error) Error() string {
 	return string([]byte(e.blob))
@@ -59,3 +70,66 @@ func (e Error) Error() string {
 func (e Error) Object() map[string]interface{} {
 	return e.object
 }
+
+// Code returns the "code" member of the error object, or 0 if it has none.
+func (e Error) Code() int {
+	switch code := e.object["code"].(type) {
+	case float64:
+		return int(code)
+	case int:
+		return code
+	case int64:
+		return int(code)
+	case json.Number:
+		n, _ := code.Int64()
+		return int(n)
+	}
+	return 0
+}
+
+// Message returns the "message" member of the error object, or an empty
+// string if it has none.
+func (e Error) Message() string {
+	msg, _ := e.object["message"].(string)
+	return msg
+}
+
+// Data returns the "data" member of the error object, or nil if it has none.
+func (e Error) Data() interface{} {
+	return e.object["data"]
+}
+
+// DecodeError is returned by the codec when a request cannot be decoded,
+// either because it is not valid JSON or because its params do not match the
+// args of the RPC method.
+type DecodeError struct {
+	// Syntax is true if the request is not valid JSON, and false if its
+	// params do not match the args.
+	Syntax bool
+	// Field is the path of the args field which failed to decode, if known.
+	Field string
+	// Err is the error returned by the JSON decoder.
+	Err error
+}
+
+// Error returns the message of the JSON decoder error.
+func (e *DecodeError) Error() string {
+	return e.Err.Error()
+}
+
+// newDecodeError wraps an error returned by the JSON decoder, or returns nil
+// if err is nil.
+func newDecodeError(err error) error {
+	switch e := err.(type) {
+	case nil:
+		return nil
+	case *json.SyntaxError:
+		return &DecodeError{Syntax: true, Err: err}
+	case *json.UnmarshalTypeError:
+		return &DecodeError{Field: e.Field, Err: err}
+	}
+	if err == io.ErrUnexpectedEOF {
+		return &DecodeError{Syntax: true, Err: err}
+	}
+	return &DecodeError{Err: err}
+}
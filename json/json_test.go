@@ -9,10 +9,14 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
+	"unicode/utf16"
 
 	"github.com/x-formation/rpc"
 )
@@ -56,6 +60,67 @@ func (t *Service1) JsonResponseError(r *http.Request, req *Service1Request, res
 	return ErrJsonResponseError
 }
 
+func (t *Service1) Sum(r *http.Request, req *[]int, res *int) error {
+	for _, n := range *req {
+		*res += n
+	}
+	return nil
+}
+
+func (t *Service1) Count(r *http.Request, req *[]string, res *map[string]int) error {
+	*res = make(map[string]int)
+	for _, s := range *req {
+		(*res)[s]++
+	}
+	return nil
+}
+
+func (t *Service1) Countdown(r *http.Request, req *int, stream rpc.Stream) error {
+	for n := *req; n > 0; n-- {
+		if err := stream.Send(n); err != nil {
+			return err
+		}
+	}
+	return ErrResponseError
+}
+
+type PartialResponse struct {
+	Done    []int
+	Skipped []string
+}
+
+func (r *PartialResponse) Warnings() []string {
+	return r.Skipped
+}
+
+func (t *Service1) Partial(r *http.Request, req *[]int, res *PartialResponse) error {
+	for _, n := range *req {
+		if n < 0 {
+			res.Skipped = append(res.Skipped, fmt.Sprintf("skipped %d", n))
+		} else {
+			res.Done = append(res.Done, n)
+		}
+	}
+	return nil
+}
+
+type ProxyService struct {
+	params json.RawMessage
+}
+
+func (t *ProxyService) Forward(r *http.Request, req *json.RawMessage, res *Service1Response) error {
+	t.params = *req
+	return nil
+}
+
+type Service1ChanResponse struct {
+	Result chan int
+}
+
+func (t *Service1) Channel(r *http.Request, req *Service1Request, res *Service1ChanResponse) error {
+	return nil
+}
+
 func execute(t *testing.T, s *rpc.Server, method string, req, res interface{}) error {
 	if !s.HasMethod(method) {
 		t.Fatal("Expected to be registered:", method)
@@ -116,3 +181,915 @@ func TestService(t *testing.T) {
 		t.Errorf("Expected http response code 400, but got %v", code)
 	}
 }
+
+func TestClientError(t *testing.T) {
+	var res Service1Response
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	if err, ok := execute(t, s, "Service1.JsonResponseError", &Service1Request{}, &res).(*Error); !ok {
+		t.Error("Expected to get err to be of *json.Error type")
+	} else if err.Code() != 42 || err.Message() != "this is error" || err.Data() != nil {
+		t.Errorf("Expected code 42 and message %q, but got %d and %q", "this is error", err.Code(), err.Message())
+	}
+	if err, ok := execute(t, s, "Service1.ResponseError", &Service1Request{}, &res).(*Error); !ok {
+		t.Error("Expected to get err to be of *json.Error type")
+	} else if err.Code() != 0 || err.Message() != ErrResponseError.Error() || err.Error() != ErrResponseError.Error() {
+		t.Errorf("Expected code 0 and message %q, but got %d and %q", ErrResponseError, err.Code(), err.Message())
+	}
+}
+
+func TestRegisterDecoder(t *testing.T) {
+	codec := NewCodec()
+	codec.RegisterDecoder("Service1.Multiply", "1", func(params json.RawMessage, args interface{}) error {
+		var v1 [1]struct{ X, Y int }
+		if err := json.Unmarshal(params, &v1); err != nil {
+			return err
+		}
+		*args.(*Service1Request) = Service1Request{v1[0].X, v1[0].Y}
+		return nil
+	})
+	s := rpc.NewServer()
+	s.RegisterCodec(codec, "application/json")
+	s.RegisterService(new(Service1), "")
+
+	send := func(version, body string) (res Service1Response, err error) {
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set(rpc.VersionHeader, version)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		err = DecodeClientResponse(w.Body, &res)
+		return
+	}
+	if res, err := send("1", `{"method":"Service1.Multiply","params":[{"X":4,"Y":2}],"id":1}`); err != nil || res.Result != 8 {
+		t.Errorf("Expected v1 params to be decoded to 8, but got %d (%v)", res.Result, err)
+	}
+	if res, err := send("2", `{"method":"Service1.Multiply","params":[{"A":4,"B":3}],"id":1}`); err != nil || res.Result != 12 {
+		t.Errorf("Expected v2 params to be decoded to 12, but got %d (%v)", res.Result, err)
+	}
+	if res, err := send("2", `{"method":"Service1.Multiply","params":[{"X":4,"Y":2}],"id":1}`); err != nil || res.Result != 0 {
+		t.Errorf("Expected v1 params to be ignored for v2, but got %d (%v)", res.Result, err)
+	}
+}
+
+func TestSeqHandler(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+	h := NewSeqHandler(s)
+
+	var body bytes.Buffer
+	for i := 1; i <= 3; i++ {
+		buf, _ := json.Marshal(&clientRequest{Method: "Service1.Multiply", Params: [1]interface{}{&Service1Request{i, 10}}, Id: uint64(i)})
+		body.WriteByte(0x1e)
+		body.Write(buf)
+		body.WriteByte('\n')
+	}
+	r, _ := http.NewRequest("POST", "http://localhost:8080/", &body)
+	r.Header.Set("Content-Type", SeqContentType)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	if ct := w.Header().Get("Content-Type"); ct != SeqContentType {
+		t.Errorf("Expected Content-Type %q, but got %q", SeqContentType, ct)
+	}
+	records := strings.Split(w.Body.String(), "\x1e")
+	if len(records) != 4 || records[0] != "" {
+		t.Fatalf("Expected 3 records, but got %q", w.Body.String())
+	}
+	for i, record := range records[1:] {
+		var res clientResponse
+		var result Service1Response
+		if err := json.Unmarshal([]byte(record), &res); err != nil || res.Id != uint64(i+1) {
+			t.Fatalf("Expected response %d, but got %q (%v)", i+1, record, err)
+		}
+		if err := json.Unmarshal(*res.Result, &result); err != nil || result.Result != (i+1)*10 {
+			t.Errorf("Expected result %d, but got %d (%v)", (i+1)*10, result.Result, err)
+		}
+	}
+
+	buf, _ := EncodeClientRequest("Service1.Multiply", &Service1Request{4, 2})
+	r, _ = http.NewRequest("POST", "http://localhost:8080/", bytes.NewReader(buf))
+	r.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	var res Service1Response
+	if err := DecodeClientResponse(w.Body, &res); err != nil || res.Result != 8 {
+		t.Errorf("Expected other requests to be passed to the server, but got %d (%v)", res.Result, err)
+	}
+}
+
+func TestWarnings(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	buf, _ := EncodeClientRequest("Service1.Partial", []int{1, -2, 3})
+	r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewReader(buf))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+
+	var res struct {
+		Result  PartialResponse
+		Error   interface{}
+		Warning []string
+	}
+	if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+		t.Fatal("Expected nil err, but got", err)
+	}
+	if res.Error != nil || !reflect.DeepEqual(res.Warning, []string{"skipped -2"}) || !reflect.DeepEqual(res.Result.Done, []int{1, 3}) {
+		t.Errorf("Expected a warning with a null error, but got %+v", res)
+	}
+}
+
+func TestDecodeError(t *testing.T) {
+	read := func(body string) error {
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		c := NewCodec().NewRequest(r)
+		if _, err := c.Method(); err != nil {
+			return err
+		}
+		return c.ReadRequest(&Service1Request{})
+	}
+	err := read(`{"method":"Service1.Multiply","params":[{"A":4,}],"id":1}`)
+	if e, ok := err.(*DecodeError); !ok || !e.Syntax {
+		t.Errorf("Expected a syntax *DecodeError, but got %#v", err)
+	}
+	err = read(`{"method":"Service1.Multiply","params":[{"A":"four"}],"id":1}`)
+	if e, ok := err.(*DecodeError); !ok || e.Syntax || !strings.HasSuffix(e.Field, "A") {
+		t.Errorf("Expected a *DecodeError on field A, but got %#v", err)
+	}
+	if err = read(`{"method":"Service1.Multiply","params":[{"A":4}],"id":1}`); err != nil {
+		t.Errorf("Expected nil err, but got %v", err)
+	}
+}
+
+func TestBatchBody(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	r, _ := http.NewRequest("POST", "http://localhost:8080/", strings.NewReader(`[{"method":"Service1.Multiply","params":[{"A":4,"B":2}],"id":1}]`))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+
+	if w.Code != 400 {
+		t.Errorf("Expected http response code 400, but got %v", w.Code)
+	}
+	var res Service1Response
+	if err := DecodeClientResponse(w.Body, &res); err == nil || err.Error() != ErrBatch.Error() {
+		t.Errorf("Expected err %q, but got %v", ErrBatch, err)
+	}
+}
+
+func TestDecodeClientResponseBytes(t *testing.T) {
+	var res Service1Response
+	if e, err := DecodeClientResponseBytes([]byte(`{"result":{"Result":8},"error":null,"id":1}`), &res); e != nil || err != nil || res.Result != 8 {
+		t.Errorf("Expected 8 with nil errors, but got %d (%v, %v)", res.Result, e, err)
+	}
+	if e, err := DecodeClientResponseBytes([]byte(`{"result":null,"error":{"code":42,"message":"failed"},"id":1}`), &res); e == nil || e.Code() != 42 || err != nil {
+		t.Errorf("Expected *json.Error with code 42 and nil err, but got %v and %v", e, err)
+	}
+	if e, err := DecodeClientResponseBytes([]byte(`{"result":`), &res); e != nil || err == nil {
+		t.Errorf("Expected nil *json.Error and a decoding err, but got %v and %v", e, err)
+	}
+}
+
+func TestEmptyBody(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewReader(nil))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+
+	if w.Code != 400 {
+		t.Errorf("Expected http response code 400, but got %v", w.Code)
+	}
+	if err := DecodeClientResponse(w.Body, nil); err == nil || err.Error() != ErrEmptyBody.Error() {
+		t.Errorf("Expected to get %q, but got %v", ErrEmptyBody, err)
+	}
+}
+
+func TestSliceArgs(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	var sum int
+	if err := execute(t, s, "Service1.Sum", &[]int{1, 2, 3}, &sum); err != nil {
+		t.Error("Expected err to be nil, but got:", err)
+	}
+	if sum != 6 {
+		t.Errorf("Wrong response: %v.", sum)
+	}
+
+	// The params array itself holds the slice elements.
+	body := bytes.NewBufferString(`{"method":"Service1.Sum","params":[1,2,3,4],"id":1}`)
+	r, _ := http.NewRequest("POST", "http://localhost:8080/", body)
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if err := DecodeClientResponse(w.Body, &sum); err != nil {
+		t.Error("Expected err to be nil, but got:", err)
+	}
+	if sum != 10 {
+		t.Errorf("Wrong response: %v.", sum)
+	}
+}
+
+func TestMapReply(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	var res map[string]int
+	if err := execute(t, s, "Service1.Count", &[]string{"a", "b", "a"}, &res); err != nil {
+		t.Error("Expected err to be nil, but got:", err)
+	}
+	if !reflect.DeepEqual(res, map[string]int{"a": 2, "b": 1}) {
+		t.Errorf("Wrong response: %v.", res)
+	}
+}
+
+func TestStream(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	if !s.HasMethod("Service1.Countdown") {
+		t.Fatal("Expected to be registered: Service1.Countdown")
+	}
+	buf, _ := EncodeClientRequest("Service1.Countdown", 3)
+	r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewBuffer(buf))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+
+	if !w.Flushed {
+		t.Error("Expected streamed chunks to be flushed")
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/x-ndjson; charset=utf-8" {
+		t.Errorf("Wrong content type: %q", ct)
+	}
+	decoder := json.NewDecoder(w.Body)
+	for exp := 3; exp > 0; exp-- {
+		var n int
+		var c clientResponse
+		if err := decoder.Decode(&c); err != nil {
+			t.Fatal("Expected err to be nil, but got:", err)
+		}
+		if err := json.Unmarshal(*c.Result, &n); err != nil || n != exp {
+			t.Errorf("Expected chunk %d, but got %d (%v)", exp, n, err)
+		}
+	}
+	var c clientResponse
+	if err := decoder.Decode(&c); err != nil {
+		t.Fatal("Expected err to be nil, but got:", err)
+	}
+	if c.Error != ErrResponseError.Error() {
+		t.Errorf("Expected last chunk to hold %q, but got %v", ErrResponseError, c.Error)
+	}
+}
+
+func TestRawParams(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+	proxy := new(ProxyService)
+	s.RegisterService(proxy, "")
+
+	params := `[{"A": 4, "Z": [true, null]}, "extra"]`
+	body := bytes.NewBufferString(`{"method":"ProxyService.Forward","params":` + params + `,"id":1}`)
+	r, _ := http.NewRequest("POST", "http://localhost:8080/", body)
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+
+	var res Service1Response
+	if err := DecodeClientResponse(w.Body, &res); err != nil {
+		t.Error("Expected err to be nil, but got:", err)
+	}
+	if string(proxy.params) != params {
+		t.Errorf("Expected to get %q, but got %q", params, proxy.params)
+	}
+
+	// Typed args are still decoded.
+	if err := execute(t, s, "Service1.Multiply", &Service1Request{4, 2}, &res); err != nil || res.Result != 8 {
+		t.Errorf("Expected 8 with nil err, but got %v (%v)", res.Result, err)
+	}
+}
+
+func TestWriteResponseError(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	buf, _ := EncodeClientRequest("Service1.Channel", &Service1Request{4, 2})
+	r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewBuffer(buf))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+
+	if w.Code != 500 {
+		t.Errorf("Expected http response code 500, but got %v", w.Code)
+	}
+}
+
+func TestDisallowUnknownFields(t *testing.T) {
+	codec := NewCodec()
+	s := rpc.NewServer()
+	s.RegisterCodec(codec, "application/json")
+	s.RegisterService(new(Service1), "")
+
+	send := func() *httptest.ResponseRecorder {
+		body := bytes.NewBufferString(`{"method":"Service1.Multiply","params":[{"A":4,"B":2,"C":1}],"id":1}`)
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", body)
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	var res Service1Response
+	if err := DecodeClientResponse(send().Body, &res); err != nil || res.Result != 8 {
+		t.Errorf("Expected 8 with nil err, but got %v (%v)", res.Result, err)
+	}
+	codec.DisallowUnknownFields = true
+	if code := send().Code; code != 400 {
+		t.Errorf("Expected http response code 400, but got %v", code)
+	}
+}
+
+func TestQueryArgs(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+	s.AllowQueryArgs("Service1.Multiply")
+
+	send := func(query, body string) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest("POST", "http://localhost:8080/?"+query, bytes.NewBufferString(body))
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	var res Service1Response
+	w := send("A=4&B=3", `{"method":"Service1.Multiply","id":1}`)
+	if err := DecodeClientResponse(w.Body, &res); err != nil || res.Result != 12 {
+		t.Errorf("Expected 12 with nil err, but got %v (%v)", res.Result, err)
+	}
+	w = send("B=5", `{"method":"Service1.Multiply","params":[{"A":4,"B":2}],"id":1}`)
+	if err := DecodeClientResponse(w.Body, &res); err != nil || res.Result != 20 {
+		t.Errorf("Expected 20 with nil err, but got %v (%v)", res.Result, err)
+	}
+	if code := send("A=four", `{"method":"Service1.Multiply","id":1}`).Code; code != 400 {
+		t.Errorf("Expected http response code 400, but got %v", code)
+	}
+	w = send("method=Service1.Multiply&A=4&B=3", "")
+	if err := DecodeClientResponse(w.Body, &res); err != nil || res.Result != 12 {
+		t.Errorf("Expected 12 with nil err for an empty body, but got %v (%v)", res.Result, err)
+	}
+	s.RegisterService(new(Service1), "Other")
+	if code := send("A=4&B=3", `{"method":"Other.Multiply","id":1}`).Code; code != 400 {
+		t.Errorf("Expected http response code 400, but got %v", code)
+	}
+	if code := send("method=Other.Multiply&A=4&B=3", "").Code; code != 400 {
+		t.Errorf("Expected http response code 400 for an empty body, but got %v", code)
+	}
+
+	s.SetCaseInsensitiveMethods(true)
+	w = send("A=4&B=5", `{"method":"service1.multiply","id":1}`)
+	if err := DecodeClientResponse(w.Body, &res); err != nil || res.Result != 20 {
+		t.Errorf("Expected 20 with nil err, but got %v (%v)", res.Result, err)
+	}
+	w = send("method=service1.multiply&A=4&B=4", "")
+	if err := DecodeClientResponse(w.Body, &res); err != nil || res.Result != 16 {
+		t.Errorf("Expected 16 with nil err for an empty body, but got %v (%v)", res.Result, err)
+	}
+}
+
+// headerCodec wraps the json codec, echoing the request id in a header.
+type headerCodec struct {
+	*Codec
+}
+
+func (c headerCodec) NewRequest(r *http.Request) rpc.CodecRequest {
+	return headerCodecRequest{c.Codec.NewRequest(r).(*CodecRequest)}
+}
+
+type headerCodecRequest struct {
+	*CodecRequest
+}
+
+func (c headerCodecRequest) WriteResponse(w http.ResponseWriter, reply interface{}, methodErr error) error {
+	if c.request.Id != nil {
+		w.Header().Set("X-RPC-Id", string(*c.request.Id))
+	}
+	return c.CodecRequest.WriteResponse(w, reply, methodErr)
+}
+
+func TestCodecHeaders(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(headerCodec{NewCodec()}, "application/json")
+	s.RegisterService(new(Service1), "")
+
+	body := bytes.NewBufferString(`{"method":"Service1.Multiply","params":[{"A":4,"B":2}],"id":42}`)
+	r, _ := http.NewRequest("POST", "http://localhost:8080/", body)
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+
+	header := w.Result().Header
+	if id := header.Get("X-RPC-Id"); id != "42" {
+		t.Errorf("Expected X-RPC-Id header 42, but got %q", id)
+	}
+	if ct := header.Get("Content-Type"); ct != "application/json; charset=utf-8" {
+		t.Errorf("Expected json Content-Type, but got %q", ct)
+	}
+	if header.Get("X-Content-Type-Options") != "nosniff" {
+		t.Errorf("Expected nosniff header, but got %q", header.Get("X-Content-Type-Options"))
+	}
+}
+
+func TestCharset(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	send := func(charset string, body []byte) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewReader(body))
+		r.Header.Set("Content-Type", "application/json; charset="+charset)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+	encodeUTF16 := func(s string, little bool) []byte {
+		b := []byte{0xfe, 0xff}
+		if little {
+			b = []byte{0xff, 0xfe}
+		}
+		for _, u := range utf16.Encode([]rune(s)) {
+			if little {
+				b = append(b, byte(u), byte(u>>8))
+			} else {
+				b = append(b, byte(u>>8), byte(u))
+			}
+		}
+		return b
+	}
+
+	const req = `{"method":"Service1.Count","params":[["café","café","thé"]],"id":1}`
+	for _, little := range []bool{false, true} {
+		var res map[string]int
+		w := send("UTF-16", encodeUTF16(req, little))
+		if err := DecodeClientResponse(w.Body, &res); err != nil || res["café"] != 2 || res["thé"] != 1 {
+			t.Errorf("Expected decoded counts with nil err, but got %v (%v)", res, err)
+		}
+	}
+	var res map[string]int
+	latin1 := []byte(`{"method":"Service1.Count","params":[["caf` + "\xe9" + `"]],"id":1}`)
+	if err := DecodeClientResponse(send("iso-8859-1", latin1).Body, &res); err != nil || res["café"] != 1 {
+		t.Errorf("Expected decoded counts with nil err, but got %v (%v)", res, err)
+	}
+	w := send("koi8-r", []byte(req))
+	if w.Code != 400 {
+		t.Errorf("Expected http response code 400, but got %v", w.Code)
+	}
+	if err := DecodeClientResponse(w.Body, nil); err == nil || !strings.Contains(err.Error(), `unsupported charset "koi8-r"`) {
+		t.Errorf("Expected unsupported charset error, but got %v", err)
+	}
+}
+
+func TestMethodNotAllowedError(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	r, _ := http.NewRequest("GET", "http://localhost:8080/", nil)
+	r.Header.Set("Accept", "text/html, application/json;q=0.9")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+
+	if w.Code != 405 {
+		t.Errorf("Expected http response code 405, but got %v", w.Code)
+	}
+	if ct := w.Result().Header.Get("Content-Type"); ct != "application/json; charset=utf-8" {
+		t.Errorf("Expected json Content-Type, but got %q", ct)
+	}
+	if err := DecodeClientResponse(w.Body, nil); err == nil || !strings.Contains(err.Error(), "POST method required") {
+		t.Errorf("Expected POST method required error, but got %v", err)
+	}
+}
+
+func TestErrorID(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+	s.RegisterBeforeFunc(func(i *rpc.RequestInfo) error {
+		if i.Method == "Service1.Sum" {
+			return errors.New("denied")
+		}
+		return nil
+	})
+
+	send := func(body string) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+	w := send(`{"method":"Service1.Multiply","params":[{"A":"four"}],"id":7}`)
+	if w.Code != 400 || !strings.Contains(w.Body.String(), `"id":7`) {
+		t.Errorf("Expected a 400 with the request id, but got %d %q", w.Code, w.Body.String())
+	}
+	w = send(`{"method":"Service1.Sum","params":[1,2],"id":8}`)
+	if w.Code != 403 || !strings.Contains(w.Body.String(), `"id":8`) {
+		t.Errorf("Expected a 403 with the request id, but got %d %q", w.Code, w.Body.String())
+	}
+	if err := DecodeClientResponse(w.Body, nil); err == nil || err.Error() != "denied" {
+		t.Errorf("Expected the denied error, but got %v", err)
+	}
+}
+
+func (t *Service1) Reset(r *http.Request, req *Service1Request, res *rpc.Void) error {
+	if req.A < 0 {
+		return ErrResponseError
+	}
+	return nil
+}
+
+func TestVoidReply(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	send := func(a int) map[string]interface{} {
+		buf, _ := EncodeClientRequest("Service1.Reset", &Service1Request{A: a})
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewReader(buf))
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		var res map[string]interface{}
+		json.NewDecoder(w.Body).Decode(&res)
+		return res
+	}
+
+	res := send(1)
+	if _, ok := res["result"]; ok {
+		t.Errorf("Expected no result field, but got %v", res)
+	}
+	if _, ok := res["id"]; !ok || res["error"] != nil {
+		t.Errorf("Expected id field and null error, but got %v", res)
+	}
+	res = send(-1)
+	if result, ok := res["result"]; !ok || result != nil || res["error"] != ErrResponseError.Error() {
+		t.Errorf("Expected null result with an error, but got %v", res)
+	}
+}
+
+func TestOmitResponseID(t *testing.T) {
+	codec := NewCodec()
+	s := rpc.NewServer()
+	s.RegisterCodec(codec, "application/json")
+	s.RegisterService(new(Service1), "")
+
+	send := func() []byte {
+		buf, _ := EncodeClientRequest("Service1.Multiply", &Service1Request{4, 2})
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewReader(buf))
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w.Body.Bytes()
+	}
+	fields := func(body []byte) map[string]interface{} {
+		var res map[string]interface{}
+		json.Unmarshal(body, &res)
+		return res
+	}
+
+	if _, ok := fields(send())["id"]; !ok {
+		t.Error("Expected the response to have an id field")
+	}
+	codec.OmitResponseID = true
+	body := send()
+	if res := fields(body); res["id"] != nil || len(res) != 2 {
+		t.Errorf("Expected the response to have no id field, but got %v", res)
+	}
+	var res Service1Response
+	if err := DecodeClientResponse(bytes.NewReader(body), &res); err != nil || res.Result != 8 {
+		t.Errorf("Expected 8 with nil err, but got %v (%v)", res.Result, err)
+	}
+}
+
+func TestClientRetry(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	var calls, failures int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if failures > 0 {
+			failures--
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(503)
+			return
+		}
+		s.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	var backoffs []int
+	c := NewClient(ts.URL, nil)
+	c.SetRetry(3, func(attempt int) time.Duration {
+		backoffs = append(backoffs, attempt)
+		return time.Millisecond
+	})
+
+	var res Service1Response
+	failures = 2
+	if err := c.Call("Service1.Multiply", &Service1Request{4, 2}, &res); err != nil || res.Result != 8 {
+		t.Errorf("Expected 8 with nil err, but got %v (%v)", res.Result, err)
+	}
+	if calls != 3 || !reflect.DeepEqual(backoffs, []int{1, 2}) {
+		t.Errorf("Expected 3 calls and 2 backoffs, but got %d and %v", calls, backoffs)
+	}
+
+	calls, failures = 0, 3
+	if err := c.Call("Service1.Multiply", &Service1Request{4, 2}, &res); err == nil || calls != 3 {
+		t.Errorf("Expected err after 3 calls, but got %v after %d", err, calls)
+	}
+
+	calls, failures = 0, 0
+	if _, ok := c.Call("Service1.JsonResponseError", &Service1Request{}, &res).(*Error); !ok || calls != 1 {
+		t.Errorf("Expected *json.Error after 1 call, but got %d calls", calls)
+	}
+}
+
+func (t *Service1) Echo(r *http.Request, req *string, res *string) error {
+	*res = *req
+	return nil
+}
+
+func TestDisableHTMLEscape(t *testing.T) {
+	codec := NewCodec()
+	s := rpc.NewServer()
+	s.RegisterCodec(codec, "application/json")
+	s.RegisterService(new(Service1), "")
+
+	send := func() string {
+		buf, _ := EncodeClientRequest("Service1.Echo", "<b>bold</b> & more")
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewReader(buf))
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w.Body.String()
+	}
+
+	if body := send(); !strings.Contains(body, `"\u003cb\u003ebold\u003c/b\u003e \u0026 more"`) {
+		t.Errorf("Expected escaped HTML by default, but got %s", body)
+	}
+	codec.DisableHTMLEscape = true
+	if body := send(); !strings.Contains(body, `"<b>bold</b> & more"`) {
+		t.Errorf("Expected literal HTML, but got %s", body)
+	}
+}
+
+func TestEncodeResponse(t *testing.T) {
+	w := httptest.NewRecorder()
+	if err := NewCodec().EncodeResponse(w, &Service1Response{8}, nil); err != nil {
+		t.Fatal("Expected nil err, but got", err)
+	}
+	var res clientResponse
+	var result Service1Response
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil || res.Error != nil {
+		t.Fatalf("Expected a response without error, but got %q (%v)", w.Body.String(), err)
+	}
+	if err := json.Unmarshal(*res.Result, &result); err != nil || result.Result != 8 {
+		t.Errorf("Expected 8 with nil err, but got %v (%v)", result.Result, err)
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+		t.Errorf("Expected a JSON Content-Type, but got %q", ct)
+	}
+}
+
+func TestResponseFields(t *testing.T) {
+	codec := &Codec{ResultField: "data", ErrorField: "err"}
+	s := rpc.NewServer()
+	s.RegisterCodec(codec, "application/json")
+	s.RegisterService(new(Service1), "")
+
+	send := func(method string) *httptest.ResponseRecorder {
+		buf, _ := EncodeClientRequest(method, &Service1Request{4, 2})
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewReader(buf))
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	w := send("Service1.Multiply")
+	var members map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &members); err != nil {
+		t.Fatal("Expected nil err, but got", err)
+	}
+	for _, name := range []string{"data", "err", "id"} {
+		if _, ok := members[name]; !ok {
+			t.Errorf("Expected a %q member, but got %s", name, w.Body.String())
+		}
+	}
+	if _, ok := members["result"]; ok {
+		t.Errorf("Expected no result member, but got %s", w.Body.String())
+	}
+	var res Service1Response
+	if err := codec.DecodeClientResponse(w.Body, &res); err != nil || res.Result != 8 {
+		t.Errorf("Expected 8 with nil err, but got %v (%v)", res.Result, err)
+	}
+
+	err := codec.DecodeClientResponse(send("Service1.ResponseError").Body, &res)
+	if e, ok := err.(*Error); !ok || e.Message() != ErrResponseError.Error() {
+		t.Errorf("Expected %q, but got %v", ErrResponseError, err)
+	}
+}
+
+func TestMethodNotFound(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	buf, _ := EncodeClientRequest("Service1.Divide", &Service1Request{4, 2})
+	r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewReader(buf))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != 404 {
+		t.Errorf("Expected status 404, but got %d", w.Code)
+	}
+	var res Service1Response
+	err := DecodeClientResponse(w.Body, &res)
+	e, ok := err.(*Error)
+	if !ok {
+		t.Fatalf("Expected an *Error, but got %#v", err)
+	}
+	if e.Code() != MethodNotFoundCode {
+		t.Errorf("Expected code %d, but got %d", MethodNotFoundCode, e.Code())
+	}
+	if msg := e.Message(); !strings.Contains(msg, `"Service1.Divide"`) {
+		t.Errorf("Expected the message to name the method, but got %q", msg)
+	}
+}
+
+type CommonArgs struct {
+	Tenant string
+	Trace  bool
+}
+
+type AuditArgs struct {
+	Level int
+}
+
+type EmbeddedRequest struct {
+	CommonArgs
+	*AuditArgs
+	A int
+}
+
+type EmbeddedService struct {
+	req EmbeddedRequest
+}
+
+func (t *EmbeddedService) Do(r *http.Request, req *EmbeddedRequest, res *rpc.Void) error {
+	t.req = *req
+	return nil
+}
+
+func TestEmbeddedArgs(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(&Codec{DisallowUnknownFields: true}, "application/json")
+	service := new(EmbeddedService)
+	s.RegisterService(service, "")
+
+	body := `{"method":"EmbeddedService.Do","params":[{"Tenant":"acme","Trace":true,"Level":3,"A":7}],"id":1}`
+	r, _ := http.NewRequest("POST", "http://localhost:8080/", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != 200 {
+		t.Fatalf("Expected status 200, but got %d: %s", w.Code, w.Body.String())
+	}
+	req := service.req
+	if req.Tenant != "acme" || !req.Trace || req.A != 7 {
+		t.Errorf("Expected the embedded fields to be decoded, but got %+v", req)
+	}
+	if req.AuditArgs == nil || req.Level != 3 {
+		t.Errorf("Expected the embedded pointer to be allocated and decoded, but got %+v", req.AuditArgs)
+	}
+}
+
+func TestPrettyHeader(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	send := func(pretty string) string {
+		buf, _ := EncodeClientRequest("Service1.Multiply", &Service1Request{4, 2})
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewReader(buf))
+		r.Header.Set("Content-Type", "application/json")
+		if pretty != "" {
+			r.Header.Set(PrettyHeader, pretty)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w.Body.String()
+	}
+
+	if body := send(""); strings.Count(body, "\n") != 1 {
+		t.Errorf("Expected a single line response by default, but got %q", body)
+	}
+	if body := send("false"); strings.Count(body, "\n") != 1 {
+		t.Errorf("Expected a single line response, but got %q", body)
+	}
+	body := send("true")
+	if !strings.HasPrefix(body, "{\n  \"result\": {\n    \"Result\": 8\n  },") {
+		t.Errorf("Expected an indented response, but got %q", body)
+	}
+	var res Service1Response
+	if err := DecodeClientResponse(strings.NewReader(body), &res); err != nil || res.Result != 8 {
+		t.Errorf("Expected 8 with nil err, but got %v (%v)", res.Result, err)
+	}
+}
+
+func TestPrettyHeaderStream(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	buf, _ := EncodeClientRequest("Service1.Countdown", 3)
+	r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewReader(buf))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set(PrettyHeader, "true")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+
+	lines := strings.Split(strings.TrimSuffix(w.Body.String(), "\n"), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("Expected 4 lines, one per chunk, but got %q", w.Body.String())
+	}
+	for _, line := range lines {
+		var c clientResponse
+		if err := json.Unmarshal([]byte(line), &c); err != nil {
+			t.Errorf("Expected a JSON object per line, but got %q (%v)", line, err)
+		}
+	}
+}
+
+func TestMethodNotFoundNotification(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	body := `{"method":"Service1.Divide","params":[{"A":4,"B":2}]}`
+	r, _ := http.NewRequest("POST", "http://localhost:8080/", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != 404 {
+		t.Errorf("Expected status 404, but got %d", w.Code)
+	}
+	if w.Body.Len() != 0 {
+		t.Errorf("Expected no response to a notification, but got %q", w.Body.String())
+	}
+}
+
+func TestResponseCodecHeaderOwnCodec(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	send := func(body string) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set(rpc.ResponseCodecHeader, "application/json")
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+	w := send(`{"method":"Service1.Multiply","params":[{"A":4,"B":2}],"id":7}`)
+	if !strings.Contains(w.Body.String(), `"id":7`) {
+		t.Errorf("Expected the request id to be echoed, but got %q", w.Body.String())
+	}
+	w = send(`{"method":"Service1.Multiply","params":[{"A":4,"B":2}]}`)
+	if w.Body.Len() != 0 {
+		t.Errorf("Expected no response to a notification, but got %q", w.Body.String())
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2013 X-Formation. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json
+
+import (
+	"bufio"
+	"bytes"
+	"mime"
+	"net/http"
+
+	"github.com/x-formation/rpc"
+)
+
+// SeqContentType is the content type of JSON text sequences (RFC 7464).
+const SeqContentType = "application/json-seq"
+
+// recordSeparator starts each JSON text of a sequence.
+const recordSeparator = 0x1e
+
+// NewSeqHandler returns a handler serving POST requests whose body is a JSON
+// text sequence of requests, as sent with the SeqContentType. Each request
+// is served in turn by the server, whose codec registered for
+// "application/json" must be this package codec, and its response is
+// written and flushed as a record of a JSON text sequence. Notifications get
+// no response record.
+//
+// Other requests are passed to the server unchanged.
+func NewSeqHandler(server *rpc.Server) http.Handler {
+	return &seqHandler{server: server}
+}
+
+type seqHandler struct {
+	server *rpc.Server
+}
+
+// ServeHTTP
+func (h *seqHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); r.Method != "POST" || contentType != SeqContentType {
+		h.server.ServeHTTP(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", SeqContentType)
+	body := bufio.NewReader(r.Body)
+	for {
+		record, err := body.ReadBytes(recordSeparator)
+		record = bytes.TrimSpace(bytes.TrimSuffix(record, []byte{recordSeparator}))
+		if len(record) > 0 {
+			if errWrite := h.serveRecord(w, r, record); errWrite != nil {
+				return
+			}
+		}
+		if err != nil || r.Context().Err() != nil {
+			return
+		}
+	}
+}
+
+// serveRecord serves the request of a single record, writing its response as
+// a record.
+func (h *seqHandler) serveRecord(w http.ResponseWriter, r *http.Request, record []byte) error {
+	req, err := http.NewRequest("POST", r.URL.String(), bytes.NewReader(record))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(r.Context())
+	for key, values := range r.Header {
+		switch key {
+		case "Content-Type", "Content-Length", "Content-Encoding", "Accept-Encoding", rpc.IdempotencyKeyHeader:
+			// Headers of the sequence, not of its records.
+		default:
+			req.Header[key] = values
+		}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.RemoteAddr = r.RemoteAddr
+	res := &seqRecorder{header: make(http.Header)}
+	h.server.ServeHTTP(res, req)
+	text := bytes.TrimSpace(res.body.Bytes())
+	if len(text) == 0 {
+		return nil
+	}
+	if _, err := w.Write([]byte{recordSeparator}); err != nil {
+		return err
+	}
+	if _, err := w.Write(append(text, '\n')); err != nil {
+		return err
+	}
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+// seqRecorder buffers the response to the request of a record.
+type seqRecorder struct {
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (w *seqRecorder) Header() http.Header {
+	return w.header
+}
+
+func (w *seqRecorder) Write(b []byte) (int, error) {
+	return w.body.Write(b)
+}
+
+func (w *seqRecorder) WriteHeader(status int) {
+}
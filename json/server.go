@@ -7,15 +7,31 @@
 package json
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
+	"io"
 	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
 
 	"github.com/x-formation/rpc"
 )
 
 var null = json.RawMessage([]byte("null"))
 
+// ErrEmptyBody is returned when a request is sent without a body.
+var ErrEmptyBody = errors.New("rpc: empty request body")
+
+// PrettyHeader is the request header a client may set to "true" to get the
+// response indented, e.g. for humans reading it while debugging.
+const PrettyHeader = "X-Pretty"
+
+// ErrBatch is returned when a request body is a JSON array, as sent for
+// batches of requests, which the codec does not support.
+var ErrBatch = errors.New("rpc: batch requests are not supported, send a single request object, or a JSON text sequence to a NewSeqHandler handler")
+
 // ----------------------------------------------------------------------------
 // Request and Response
 // ----------------------------------------------------------------------------
@@ -35,12 +51,16 @@ type serverRequest struct {
 type serverResponse struct {
 	// The Object that was returned by the invoked method. This must be null
 	// in case there was an error invoking the method.
-	Result interface{} `json:"result"`
+	// It is omitted for methods with a rpc.Void reply.
+	Result interface{} `json:"result,omitempty"`
 	// An Error object if there was an error invoking the method. It must be
 	// null if there was no error.
 	Error interface{} `json:"error"`
-	// This must be the same id as the request it is responding to.
-	Id *json.RawMessage `json:"id"`
+	// This must be the same id as the request it is responding to. It is
+	// omitted when the codec OmitResponseID option is set.
+	Id *json.RawMessage `json:"id,omitempty"`
+	// Non-fatal warnings of a successful call, whose reply is a rpc.Warner.
+	Warning []string `json:"warning,omitempty"`
 }
 
 // ----------------------------------------------------------------------------
@@ -54,11 +74,117 @@ func NewCodec() *Codec {
 
 // Codec creates a CodecRequest to process each request.
 type Codec struct {
+	// DisallowUnknownFields makes requests fail when their params hold
+	// fields not matching the args of the RPC method.
+	DisallowUnknownFields bool
+	// OmitResponseID makes responses leave out the id of the request, for
+	// clients which do not match responses with requests.
+	OmitResponseID bool
+	// DisableHTMLEscape makes responses hold the characters <, > and & of
+	// strings as is, rather than escaped as \u003c, \u003e and \u0026.
+	DisableHTMLEscape bool
+	// ResultField and ErrorField rename the result and error members of
+	// responses, "result" and "error" by default, for clients of JSON-RPC
+	// dialects naming them otherwise, e.g. "data" and "err".
+	ResultField string
+	ErrorField  string
+
+	decoders map[string]Decoder
+}
+
+// Decoder decodes the raw params array of a request into the args of the
+// RPC method.
+type Decoder func(params json.RawMessage, args interface{}) error
+
+// RegisterDecoder makes the codec decode the params of the requests to a
+// method sent with the given rpc.VersionHeader with the decoder, e.g. to
+// keep serving clients of a former API version. Requests without a decoder
+// for their version are decoded as usual.
+//
+// It must be called before the server starts serving requests. The method
+// uses a dotted notation as in "Service.Method".
+func (c *Codec) RegisterDecoder(method, version string, decoder Decoder) {
+	if c.decoders == nil {
+		c.decoders = make(map[string]Decoder)
+	}
+	c.decoders[version+" "+method] = decoder
 }
 
 // NewRequest returns a CodecRequest.
 func (c *Codec) NewRequest(r *http.Request) rpc.CodecRequest {
-	return newCodecRequest(r)
+	return newCodecRequest(r, c)
+}
+
+// WriteError encodes an error for a request the codec did not read, as a
+// response with null result and id.
+func (c *Codec) WriteError(w http.ResponseWriter, status int, err error) error {
+	res := &serverResponse{Result: &null, Error: err.Error(), Id: &null}
+	if c.OmitResponseID {
+		res.Id = nil
+	}
+	if e, ok := err.(*Error); ok {
+		res.Error = e.Object()
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	return c.encode(w, res, false)
+}
+
+// EncodeResponse encodes a response to a request the codec did not read, e.g.
+// for a client asking for a JSON response with rpc.ResponseCodecHeader, with
+// a null id.
+func (c *Codec) EncodeResponse(w http.ResponseWriter, reply interface{}, methodErr error) error {
+	req := &CodecRequest{request: &serverRequest{Id: &null}, codec: c}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	return c.encode(w, req.response(reply, methodErr), false)
+}
+
+// encoder returns an encoder writing responses to w, following the codec
+// options, and indented if requested.
+func (c *Codec) encoder(w io.Writer, indent bool) *json.Encoder {
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(!c.DisableHTMLEscape)
+	if indent {
+		encoder.SetIndent("", "  ")
+	}
+	return encoder
+}
+
+// encode writes a response to w, with the member names set by the codec
+// options, and indented if requested.
+func (c *Codec) encode(w io.Writer, res *serverResponse, indent bool) error {
+	if c.ResultField == "" && c.ErrorField == "" {
+		return c.encoder(w, indent).Encode(res)
+	}
+	// The members are renamed in a map, which holds them as the struct tags
+	// of serverResponse would.
+	members := map[string]interface{}{c.errorField(): res.Error}
+	if res.Result != nil {
+		members[c.resultField()] = res.Result
+	}
+	if res.Id != nil {
+		members["id"] = res.Id
+	}
+	if len(res.Warning) > 0 {
+		members["warning"] = res.Warning
+	}
+	return c.encoder(w, indent).Encode(members)
+}
+
+// resultField returns the name of the result member of responses.
+func (c *Codec) resultField() string {
+	if c.ResultField == "" {
+		return "result"
+	}
+	return c.ResultField
+}
+
+// errorField returns the name of the error member of responses.
+func (c *Codec) errorField() string {
+	if c.ErrorField == "" {
+		return "error"
+	}
+	return c.ErrorField
 }
 
 // ----------------------------------------------------------------------------
@@ -66,18 +192,49 @@ func (c *Codec) NewRequest(r *http.Request) rpc.CodecRequest {
 // ----------------------------------------------------------------------------
 
 // newCodecRequest returns a new CodecRequest.
-func newCodecRequest(r *http.Request) rpc.CodecRequest {
+func newCodecRequest(r *http.Request, codec *Codec) rpc.CodecRequest {
 	// Decode the request body and check if RPC method is valid.
 	req := new(serverRequest)
-	err := json.NewDecoder(r.Body).Decode(req)
+	body, err := decodeCharset(r.Body, charset(r))
+	if err == nil {
+		err = json.NewDecoder(body).Decode(req)
+		switch e := err.(type) {
+		case *json.UnmarshalTypeError:
+			if e.Value == "array" && e.Field == "" {
+				err = ErrBatch
+			} else {
+				err = newDecodeError(err)
+			}
+		case *json.SyntaxError:
+			err = newDecodeError(err)
+		}
+		if err == io.EOF {
+			err = ErrEmptyBody
+		} else if err == io.ErrUnexpectedEOF {
+			err = newDecodeError(err)
+		}
+	}
 	r.Body.Close()
-	return &CodecRequest{request: req, err: err}
+	return &CodecRequest{request: req, err: err, codec: codec, version: r.Header.Get(rpc.VersionHeader), httpReq: r}
 }
 
 // CodecRequest decodes and encodes a single request.
 type CodecRequest struct {
 	request *serverRequest
 	err     error
+	codec   *Codec
+	version string
+	httpReq *http.Request
+}
+
+// pretty returns true if the client asked for an indented response with the
+// PrettyHeader.
+func (c *CodecRequest) pretty() bool {
+	if c.httpReq == nil {
+		return false
+	}
+	on, _ := strconv.ParseBool(c.httpReq.Header.Get(PrettyHeader))
+	return on
 }
 
 // Method returns the RPC method for the current request.
@@ -91,13 +248,28 @@ func (c *CodecRequest) Method() (string, error) {
 }
 
 // ReadRequest fills the request object for the RPC method.
+//
+// If args is a *json.RawMessage, it receives the raw params array untouched,
+// deferring its decoding to the RPC method. Params which cannot be decoded
+// into args fail with a *DecodeError. The fields of structs embedded in args
+// are read from the params object as if they were fields of args.
 func (c *CodecRequest) ReadRequest(args interface{}) error {
 	if c.err == nil {
-		if c.request.Params != nil {
+		decoder := c.codec.decoders[c.version+" "+c.request.Method]
+		if decoder != nil && c.request.Params != nil {
+			c.err = decoder(*c.request.Params, args)
+		} else if raw, ok := args.(*json.RawMessage); ok && c.request.Params != nil {
+			*raw = append((*raw)[:0], *c.request.Params...)
+		} else if c.request.Params != nil {
 			// JSON params is array value. RPC params is struct.
 			// Unmarshal into array containing the request struct.
 			params := [1]interface{}{args}
-			c.err = json.Unmarshal(*c.request.Params, &params)
+			c.err = c.unmarshal(*c.request.Params, &params)
+			if c.err != nil && isSlice(args) {
+				// RPC params is a slice, which may be passed as the
+				// JSON params array itself.
+				c.err = c.unmarshal(*c.request.Params, args)
+			}
 		} else {
 			c.err = errors.New("rpc: method request ill-formed: missing params field")
 		}
@@ -105,6 +277,42 @@ func (c *CodecRequest) ReadRequest(args interface{}) error {
 	return c.err
 }
 
+// ReadQuery fills the request object for the RPC method from the params, if
+// any, then assigns the URL query values to its fields.
+func (c *CodecRequest) ReadQuery(query url.Values, args interface{}) error {
+	if c.err == nil && c.request.Params != nil {
+		c.ReadRequest(args)
+	}
+	if c.err == nil {
+		c.err = rpc.DecodeValues(query, args)
+	}
+	return c.err
+}
+
+// WriteError encodes an error the server responds with once the request was
+// read, as a response with null result and the request id, if decoded.
+func (c *CodecRequest) WriteError(w http.ResponseWriter, status int, err error) error {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	return c.codec.encode(w, c.response(nil, err), c.pretty())
+}
+
+// unmarshal decodes JSON data into v, following the codec options. Errors
+// are returned as *DecodeError.
+func (c *CodecRequest) unmarshal(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if c.codec.DisallowUnknownFields {
+		decoder.DisallowUnknownFields()
+	}
+	return newDecodeError(decoder.Decode(v))
+}
+
+// isSlice returns true if args is a pointer to a slice.
+func isSlice(args interface{}) bool {
+	t := reflect.TypeOf(args)
+	return t.Kind() == reflect.Ptr && t.Elem().Kind() == reflect.Slice
+}
+
 // WriteResponse encodes the response and writes it to the ResponseWriter.
 //
 // The err parameter is the error resulted from calling the RPC method,
@@ -113,11 +321,79 @@ func (c *CodecRequest) WriteResponse(w http.ResponseWriter, reply interface{}, m
 	if c.err != nil {
 		return c.err
 	}
+	res := c.response(reply, methodErr)
+	if c.request.Id == nil {
+		// Id is null for notifications and they don't have a response.
+		res.Id = &null
+	} else {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		return c.codec.encode(w, res, c.pretty())
+	}
+	return nil
+}
+
+// WriteChunk encodes a single chunk of a streamed response and writes it to
+// the ResponseWriter, as a JSON object followed by a newline. Chunks are
+// never indented, even with the PrettyHeader, to keep one object per line.
+//
+// The err parameter is the error resulted from calling the RPC method,
+// or nil if there was no error.
+func (c *CodecRequest) WriteChunk(w http.ResponseWriter, chunk interface{}, methodErr error) error {
+	if c.err != nil {
+		return c.err
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson; charset=utf-8")
+	return c.codec.encode(w, c.response(chunk, methodErr), false)
+}
+
+// MethodNotFoundCode is the code of the error object responding to requests
+// for methods which are not registered, as set by JSON-RPC 2.0.
+const MethodNotFoundCode = -32601
+
+// WriteMethodNotFound writes a 404 response to a request for a method which
+// is not registered, whose error is an object with the MethodNotFoundCode
+// code and the error message, as in:
+//
+//	{"code": -32601, "message": "rpc: can't find method ..."}
+//
+// Notifications, which don't have a response, only get the status.
+func (c *CodecRequest) WriteMethodNotFound(w http.ResponseWriter, method string, err error) error {
+	if c.err != nil {
+		return c.err
+	}
+	if c.request.Id == nil {
+		w.WriteHeader(404)
+		return nil
+	}
+	e := NewErrorObject(map[string]interface{}{
+		"code":    MethodNotFoundCode,
+		"message": err.Error(),
+	})
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(404)
+	return c.codec.encode(w, c.response(nil, e), c.pretty())
+}
+
+// response returns the response for the RPC method reply and error.
+func (c *CodecRequest) response(reply interface{}, methodErr error) *serverResponse {
 	res := &serverResponse{
 		Result: reply,
 		Error:  &null,
 		Id:     c.request.Id,
 	}
+	if c.codec.OmitResponseID {
+		res.Id = nil
+	} else if res.Id == nil {
+		res.Id = &null
+	}
+	if reply == nil {
+		res.Result = &null
+	} else if rpc.IsVoid(reply) {
+		res.Result = nil
+	}
+	if w, ok := reply.(rpc.Warner); ok && methodErr == nil {
+		res.Warning = w.Warnings()
+	}
 	if methodErr != nil {
 		if e, ok := methodErr.(*Error); ok {
 			res.Error = e.Object()
@@ -128,13 +404,5 @@ func (c *CodecRequest) WriteResponse(w http.ResponseWriter, reply interface{}, m
 		// http://json-rpc.org/wiki/specification#a1.2Response
 		res.Result = &null
 	}
-	if c.request.Id == nil {
-		// Id is null for notifications and they don't have a response.
-		res.Id = &null
-	} else {
-		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		encoder := json.NewEncoder(w)
-		encoder.Encode(res)
-	}
-	return nil
+	return res
 }
@@ -0,0 +1,115 @@
+// Copyright 2013 X-Formation. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import "fmt"
+
+// Initializer is implemented by service receivers needing a one-time setup,
+// e.g. to warm caches. Init is called when the service is registered, which
+// fails if Init returns an error.
+type Initializer interface {
+	Init() error
+}
+
+// Closer is implemented by service receivers releasing resources when the
+// service is unregistered with UnregisterService, or when the server is
+// closed.
+type Closer interface {
+	Close() error
+}
+
+// UnregisterService removes the service registered under the given name,
+// closing its receiver if it is a Closer, unless the receiver remains
+// registered under another name, as with RegisterServiceAliases. Requests
+// already being served by the service are not waited for.
+func (s *Server) UnregisterService(name string) error {
+	service, err := s.services.unregister(name)
+	if err != nil || service == nil {
+		return err
+	}
+	return service.close()
+}
+
+// Close closes the receivers of all the registered services which are
+// Closers, once each, and returns the first error returned. It is meant to
+// be called once the server stopped serving requests, e.g. after Drain and
+// Wait. The services remain registered.
+func (s *Server) Close() (err error) {
+	for _, service := range s.services.receivers() {
+		if errClose := service.close(); err == nil {
+			err = errClose
+		}
+	}
+	return
+}
+
+// init initializes the service receiver if it is an Initializer.
+func (s *service) init() error {
+	if s.rcvr.IsValid() {
+		if i, ok := s.rcvr.Interface().(Initializer); ok {
+			if err := i.Init(); err != nil {
+				return fmt.Errorf("rpc: service %q failed to initialize: %v", s.name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// close closes the service receiver if it is a Closer.
+func (s *service) close() error {
+	if s.rcvr.IsValid() {
+		if c, ok := s.rcvr.Interface().(Closer); ok {
+			return c.Close()
+		}
+	}
+	return nil
+}
+
+// unregister removes a service from the map. It returns the service to be
+// closed, or nil if its receiver is still registered under another name.
+func (m *serviceMap) unregister(name string) (*service, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	s := m.services[name]
+	if s == nil || s.builtin {
+		return nil, &notFoundError{fmt.Sprintf("rpc: can't find service %q", name)}
+	}
+	delete(m.services, name)
+	if m.hasReceiverLocked(s) {
+		return nil, nil
+	}
+	return s, nil
+}
+
+// hasReceiverLocked returns true if a registered service shares the receiver
+// of the given service, for callers holding the mutex.
+func (m *serviceMap) hasReceiverLocked(s *service) bool {
+	if !s.rcvr.IsValid() {
+		return false
+	}
+	for _, other := range m.services {
+		if other.rcvr.IsValid() && other.rcvr.Interface() == s.rcvr.Interface() {
+			return true
+		}
+	}
+	return false
+}
+
+// receivers returns a service for each distinct receiver of the registered
+// services, as aliases share their receiver.
+func (m *serviceMap) receivers() []*service {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	seen := make(map[interface{}]bool)
+	var services []*service
+	for _, s := range m.services {
+		if s.builtin || !s.rcvr.IsValid() || seen[s.rcvr.Interface()] {
+			continue
+		}
+		seen[s.rcvr.Interface()] = true
+		services = append(services, s)
+	}
+	return services
+}
@@ -0,0 +1,92 @@
+// Copyright 2013 X-Formation. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"reflect"
+	"time"
+)
+
+// Logger is the interface used by the server to log requests. It is
+// satisfied by *log.Logger.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// SetLogger makes the server log the method name, client IP, status and
+// latency of every request served.
+//
+// Request bodies are never logged. The args of a method are logged only once
+// its sensitive fields have been declared with RedactFields.
+func (s *Server) SetLogger(l Logger) {
+	s.logger = l
+}
+
+// RedactFields makes the server log the args of the given method, masking
+// the values of the named args fields.
+//
+// The method uses a dotted notation as in "Service.Method".
+func (s *Server) RedactFields(method string, fields ...string) {
+	if s.redacted == nil {
+		s.redacted = make(map[string]map[string]bool)
+	}
+	redacted := s.redacted[method]
+	if redacted == nil {
+		redacted = make(map[string]bool)
+		s.redacted[method] = redacted
+	}
+	for _, field := range fields {
+		redacted[field] = true
+	}
+}
+
+// logRequest logs a served request.
+func (s *Server) logRequest(r *http.Request, state *requestState, status int, latency time.Duration) {
+	ip := r.RemoteAddr
+	if state.ip != nil {
+		ip = state.ip.String()
+	}
+	var id string
+	if requestID := RequestID(r.Context()); requestID != "" {
+		id = " id=" + requestID
+	}
+	redacted, ok := s.redacted[state.method]
+	if !ok || !state.args.IsValid() {
+		s.logger.Printf("rpc: method=%q ip=%s status=%d latency=%s%s",
+			state.method, ip, status, latency, id)
+		return
+	}
+	s.logger.Printf("rpc: method=%q ip=%s status=%d latency=%s%s args=%s",
+		state.method, ip, status, latency, id, formatArgs(state.args, redacted))
+}
+
+// formatArgs formats the method args, masking the redacted struct fields.
+func formatArgs(args reflect.Value, redacted map[string]bool) string {
+	v := reflect.Indirect(args)
+	if v.Kind() != reflect.Struct {
+		return fmt.Sprintf("%+v", v.Interface())
+	}
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, n := 0, 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		if n++; n > 1 {
+			buf.WriteByte(' ')
+		}
+		if redacted[field.Name] {
+			fmt.Fprintf(&buf, "%s:***", field.Name)
+		} else {
+			fmt.Fprintf(&buf, "%s:%+v", field.Name, v.Field(i).Interface())
+		}
+	}
+	buf.WriteByte('}')
+	return buf.String()
+}
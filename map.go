@@ -6,9 +6,11 @@
 package rpc
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"reflect"
+	"sort"
 	"strings"
 	"sync"
 	"unicode"
@@ -23,23 +25,92 @@ var (
 	// Same as above, this time for http.Request.
 	unusedRequest *http.Request
 	typeOfRequest = reflect.TypeOf(unusedRequest).Elem()
+	// Same as above, this time for Stream.
+	unusedStream *Stream
+	typeOfStream = reflect.TypeOf(unusedStream).Elem()
+	// Same as above, this time for http.ResponseWriter.
+	unusedResponseWriter *http.ResponseWriter
+	typeOfResponseWriter = reflect.TypeOf(unusedResponseWriter).Elem()
+	// Same as above, this time for RawBody.
+	unusedRawBody *RawBody
+	typeOfRawBody = reflect.TypeOf(unusedRawBody).Elem()
 )
 
+// notFoundError is returned by serviceMap.get when the requested service or
+// method is not registered.
+type notFoundError struct {
+	msg string
+}
+
+func (e *notFoundError) Error() string {
+	return e.msg
+}
+
 // ----------------------------------------------------------------------------
 // service
 // ----------------------------------------------------------------------------
 
 type service struct {
 	name     string                    // name of service
-	rcvr     reflect.Value             // receiver of methods for the service
+	rcvr     reflect.Value             // receiver of methods, invalid for functions
 	rcvrType reflect.Type              // type of the receiver
 	methods  map[string]*serviceMethod // registered methods
+	builtin  bool                      // provided by the server itself
+	codec    Codec                     // codec encoding responses, if not nil
 }
 
 type serviceMethod struct {
-	method    reflect.Method // receiver method
-	argsType  reflect.Type   // type of the request argument
-	replyType reflect.Type   // type of the response argument
+	method       reflect.Method // receiver method
+	argsType     reflect.Type   // type of the request argument
+	replyType    reflect.Type   // type of the response argument
+	returnsReply bool           // reply is returned instead of being an argument
+	streams      bool           // reply argument is a Stream
+	writes       bool           // method writes the response itself
+	required     []int          // indices of the args fields tagged rpc:"required"
+}
+
+// call invokes the method, returning its reply and error. The reply
+// parameter is ignored by methods returning their reply, and the rcvr
+// parameter is invalid for standalone functions.
+func (m *serviceMethod) call(rcvr, r, args, reply reflect.Value) (reflect.Value, error) {
+	in := make([]reflect.Value, 0, 4)
+	if rcvr.IsValid() {
+		in = append(in, rcvr)
+	}
+	if m.writes {
+		// The reply parameter holds the http.ResponseWriter.
+		out := m.method.Func.Call(append(in, reply, r, args))
+		return reflect.Value{}, toError(out[0])
+	}
+	in = append(in, r, args)
+	if m.returnsReply {
+		out := m.method.Func.Call(in)
+		return out[0], toError(out[1])
+	}
+	out := m.method.Func.Call(append(in, reply))
+	return reply, toError(out[0])
+}
+
+// missing returns the names of the required fields of the args which are
+// not set.
+func (m *serviceMethod) missing(args reflect.Value) []string {
+	var names []string
+	args = reflect.Indirect(args)
+	for _, i := range m.required {
+		field := args.Field(i)
+		if isZero(field) {
+			names = append(names, m.argsType.Field(i).Name)
+		}
+	}
+	return names
+}
+
+// toError casts the result to error if needed.
+func toError(v reflect.Value) error {
+	if err := v.Interface(); err != nil {
+		return err.(error)
+	}
+	return nil
 }
 
 // ----------------------------------------------------------------------------
@@ -50,107 +121,662 @@ type serviceMethod struct {
 type serviceMap struct {
 	mutex    sync.Mutex
 	services map[string]*service
+	fold     bool   // match names case-insensitively
+	reserved string // service name prefix reserved to built-in services
+	raw      bool   // some method args are a RawBody
+	infer    func(reflect.Type) string
+}
+
+// setReserved sets the service name prefix reserved to built-in services.
+func (m *serviceMap) setReserved(prefix string) {
+	m.mutex.Lock()
+	m.reserved = prefix
+	m.mutex.Unlock()
+}
+
+// setInferrer sets the function inferring the name of services registered
+// without one.
+func (m *serviceMap) setInferrer(infer func(reflect.Type) string) {
+	m.mutex.Lock()
+	m.infer = infer
+	m.mutex.Unlock()
+}
+
+// serviceName returns the given service name or, if empty, the name given by
+// the name inferrer for the receiver, if set.
+func (m *serviceMap) serviceName(rcvr interface{}, name string) (string, error) {
+	m.mutex.Lock()
+	infer := m.infer
+	m.mutex.Unlock()
+	if name != "" || infer == nil {
+		return name, nil
+	}
+	t := reflect.TypeOf(rcvr)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if name = infer(t); name == "" {
+		return "", fmt.Errorf("rpc: no service name for type %q", t.String())
+	}
+	return name, nil
+}
+
+// setFold makes the map match service and method names case-insensitively.
+func (m *serviceMap) setFold(fold bool) {
+	m.mutex.Lock()
+	m.fold = fold
+	m.mutex.Unlock()
+}
+
+// folding returns true if the map matches names case-insensitively.
+func (m *serviceMap) folding() bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.fold
+}
+
+// serviceOptions holds the options of a service registration.
+type serviceOptions struct {
+	replace bool                     // replace a service of the same name
+	codec   Codec                    // codec encoding the responses, if not nil
+	namer   func(name string) string // maps Go method names, if not nil
+	builtin bool                     // service provided by the server itself
 }
 
 // register adds a new service using reflection to extract its methods.
-func (m *serviceMap) register(rcvr interface{}, name string) error {
+//
+// Registering a service under the name of an already registered one fails,
+// unless the replace option is set.
+func (m *serviceMap) register(rcvr interface{}, name string, opts serviceOptions) error {
+	name, err := m.serviceName(rcvr, name)
+	if err != nil {
+		return err
+	}
+	s, err := newService(rcvr, name)
+	if err != nil {
+		return err
+	}
+	if opts.namer != nil {
+		methods := make(map[string]*serviceMethod, len(s.methods))
+		for name, method := range s.methods {
+			mapped := opts.namer(name)
+			if mapped == "" || strings.Contains(mapped, ".") {
+				return fmt.Errorf("rpc: method %q mapped to invalid name %q", name, mapped)
+			}
+			if other, ok := methods[mapped]; ok {
+				return fmt.Errorf("rpc: methods %q and %q both mapped to %q",
+					other.method.Name, name, mapped)
+			}
+			methods[mapped] = method
+		}
+		s.methods = methods
+	}
+	s.codec = opts.codec
+	s.builtin = opts.builtin
+	if err := s.init(); err != nil {
+		return err
+	}
+	replaced, err := m.add(s, opts.replace)
+	if err != nil {
+		s.close()
+		return err
+	}
+	if replaced != nil {
+		return replaced.close()
+	}
+	return nil
+}
+
+// registerAliases adds a service under each of the given names, sharing a
+// single reflection of the receiver. An empty first name is inferred as for
+// register, while the other names must be set. Either all names are
+// registered or, if any of them fails, none is.
+func (m *serviceMap) registerAliases(rcvr interface{}, names []string) error {
+	if len(names) == 0 {
+		return errors.New("rpc: no service name given")
+	}
+	first, err := m.serviceName(rcvr, names[0])
+	if err != nil {
+		return err
+	}
+	s, err := newService(rcvr, first)
+	if err != nil {
+		return err
+	}
+	if err := s.init(); err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	added := make([]string, 0, len(names))
+	for i, name := range names {
+		if i == 0 {
+			// The name inferred from the receiver if none was given.
+			name = s.name
+		}
+		alias := *s
+		alias.name = name
+		if name == "" {
+			err = fmt.Errorf("rpc: no service name for type %q", s.rcvrType.String())
+		} else {
+			err = m.addLocked(&alias, false)
+		}
+		if err != nil {
+			for _, name := range added {
+				delete(m.services, name)
+			}
+			s.close()
+			return err
+		}
+		added = append(added, name)
+	}
+	return nil
+}
+
+// registerBuiltin adds a service provided by the server itself. Method names
+// of built-in services begin with a lower case letter, as in
+// "rpc.listMethods", so that they read differently from user methods.
+func (m *serviceMap) registerBuiltin(rcvr interface{}, name string) error {
+	return m.register(rcvr, name, serviceOptions{namer: lowerFirst, builtin: true})
+}
+
+// lowerFirst returns the name with its first letter lower cased.
+func lowerFirst(name string) string {
+	r, n := utf8.DecodeRuneInString(name)
+	return string(unicode.ToLower(r)) + name[n:]
+}
+
+// newService creates a service using reflection to extract its methods.
+func newService(rcvr interface{}, name string) (*service, error) {
 	// Setup service.
+	v := reflect.ValueOf(rcvr)
+	if v.Kind() != reflect.Ptr {
+		// Use a pointer to a copy of the value, so that methods declared
+		// on both value and pointer receivers are found.
+		p := reflect.New(v.Type())
+		p.Elem().Set(v)
+		v = p
+	}
 	s := &service{
 		name:     name,
-		rcvr:     reflect.ValueOf(rcvr),
-		rcvrType: reflect.TypeOf(rcvr),
+		rcvr:     v,
+		rcvrType: v.Type(),
 		methods:  make(map[string]*serviceMethod),
 	}
 	if name == "" {
 		s.name = reflect.Indirect(s.rcvr).Type().Name()
 		if !isExported(s.name) {
-			return fmt.Errorf("rpc: type %q is not exported", s.name)
+			return nil, fmt.Errorf("rpc: type %q is not exported", s.name)
 		}
 	}
 	if s.name == "" {
-		return fmt.Errorf("rpc: no service name for type %q",
+		return nil, fmt.Errorf("rpc: no service name for type %q",
 			s.rcvrType.String())
 	}
+	if !validServiceName(s.name) {
+		return nil, fmt.Errorf("rpc: service name ill-formed: %q", s.name)
+	}
 	// Setup methods.
+	examined := 0
 	for i := 0; i < s.rcvrType.NumMethod(); i++ {
 		method := s.rcvrType.Method(i)
-		mtype := method.Type
 		// Method must be exported.
 		if method.PkgPath != "" {
 			continue
 		}
-		// Method needs four ins: receiver, *http.Request, *args, *reply.
-		if mtype.NumIn() != 4 {
+		examined++
+		m, err := newServiceMethod(method, 1)
+		if err != nil {
+			if looksLikeRPC(method) {
+				// Only report methods meant to be called through RPC,
+				// ignoring unrelated helpers.
+				return nil, err
+			}
 			continue
 		}
-		// First argument must be a pointer and must be http.Request.
-		reqType := mtype.In(1)
-		if reqType.Kind() != reflect.Ptr || reqType.Elem() != typeOfRequest {
-			continue
+		s.methods[method.Name] = m
+	}
+	if len(s.methods) == 0 {
+		return nil, fmt.Errorf("rpc: %q of type %s has no exported methods of suitable type, %d examined",
+			s.name, typePath(s.rcvrType), examined)
+	}
+	return s, nil
+}
+
+// newServiceMethod returns the serviceMethod for a method or function with a
+// suitable signature. The first skip arguments of the method type, such as
+// the receiver, are not checked.
+func newServiceMethod(method reflect.Method, skip int) (*serviceMethod, error) {
+	mtype := method.Type
+	in := func(i int) reflect.Type { return mtype.In(skip + i) }
+	// Method needs three ins: *http.Request, *args, *reply; or two ins when
+	// the reply is returned.
+	if mtype.NumIn() != skip+2 && mtype.NumIn() != skip+3 {
+		return nil, fmt.Errorf("rpc: %s needs 2 or 3 arguments, got %d", method.Name, mtype.NumIn()-skip)
+	}
+	if mtype.NumIn() == skip+3 && in(0) == typeOfResponseWriter {
+		return newWriterMethod(method, skip)
+	}
+	// First argument must be a pointer and must be http.Request.
+	reqType := in(0)
+	if reqType.Kind() != reflect.Ptr || reqType.Elem() != typeOfRequest {
+		return nil, fmt.Errorf("rpc: %s first argument must be *http.Request, got %s", method.Name, reqType)
+	}
+	// Second argument must be a pointer and must be exported.
+	args := in(1)
+	if args.Kind() != reflect.Ptr || !isExportedOrBuiltin(args) {
+		return nil, fmt.Errorf("rpc: %s args must be an exported pointer, got %s", method.Name, args)
+	}
+	var reply reflect.Type
+	returnsReply := mtype.NumIn() == skip+2
+	streams := !returnsReply && in(2) == typeOfStream
+	if streams {
+		// Method needs one out: error.
+		if mtype.NumOut() != 1 {
+			return nil, fmt.Errorf("rpc: %s must return error only", method.Name)
 		}
-		// Second argument must be a pointer and must be exported.
-		args := mtype.In(2)
-		if args.Kind() != reflect.Ptr || !isExportedOrBuiltin(args) {
-			continue
+	} else if returnsReply {
+		// Method needs two outs: reply, error.
+		if mtype.NumOut() != 2 {
+			return nil, fmt.Errorf("rpc: %s must return a reply and an error", method.Name)
+		}
+		// Returned reply must be exported.
+		if reply = mtype.Out(0); !isExportedOrBuiltin(reply) {
+			return nil, fmt.Errorf("rpc: %s reply must be exported, got %s", method.Name, reply)
 		}
+	} else {
 		// Third argument must be a pointer and must be exported.
-		reply := mtype.In(3)
+		reply = in(2)
 		if reply.Kind() != reflect.Ptr || !isExportedOrBuiltin(reply) {
-			continue
+			return nil, fmt.Errorf("rpc: %s reply must be an exported pointer, got %s", method.Name, reply)
 		}
+		reply = reply.Elem()
 		// Method needs one out: error.
 		if mtype.NumOut() != 1 {
-			continue
+			return nil, fmt.Errorf("rpc: %s must return error only", method.Name)
 		}
-		if returnType := mtype.Out(0); returnType != typeOfOsError {
-			continue
+	}
+	if returnType := mtype.Out(mtype.NumOut() - 1); returnType != typeOfOsError {
+		return nil, fmt.Errorf("rpc: %s must return error, got %s", method.Name, returnType)
+	}
+	return &serviceMethod{
+		method:       method,
+		argsType:     args.Elem(),
+		required:     requiredFields(args.Elem()),
+		replyType:    reply,
+		returnsReply: returnsReply,
+		streams:      streams,
+	}, nil
+}
+
+// typePath returns the name of a type qualified by its full package path, as
+// in "*github.com/user/pkg.Type".
+func typePath(t reflect.Type) string {
+	if t.Kind() == reflect.Ptr {
+		return "*" + typePath(t.Elem())
+	}
+	if t.PkgPath() == "" || t.Name() == "" {
+		return t.String()
+	}
+	return t.PkgPath() + "." + t.Name()
+}
+
+// looksLikeRPC returns true if the exported method, rejected by
+// newServiceMethod, is a near miss of an RPC method: it has the arguments
+// and results of one, starting with *http.Request, but its args or reply
+// is not a pointer.
+func looksLikeRPC(method reflect.Method) bool {
+	mtype := method.Type
+	if mtype.NumIn() < 3 || mtype.In(1) != reflect.PtrTo(typeOfRequest) {
+		return false
+	}
+	switch {
+	case mtype.NumIn() == 3 && mtype.NumOut() == 2 && mtype.Out(1) == typeOfOsError:
+		// The reply is returned.
+		return mtype.In(2).Kind() != reflect.Ptr
+	case mtype.NumIn() == 4 && mtype.NumOut() == 1 && mtype.Out(0) == typeOfOsError:
+		reply := mtype.In(3)
+		return mtype.In(2).Kind() != reflect.Ptr || reply.Kind() != reflect.Ptr && reply != typeOfStream
+	}
+	return false
+}
+
+// newWriterMethod returns a method writing the response itself, whose
+// arguments are http.ResponseWriter, *http.Request, *args.
+func newWriterMethod(method reflect.Method, skip int) (*serviceMethod, error) {
+	mtype := method.Type
+	if reqType := mtype.In(skip + 1); reqType.Kind() != reflect.Ptr || reqType.Elem() != typeOfRequest {
+		return nil, fmt.Errorf("rpc: %s second argument must be *http.Request, got %s", method.Name, reqType)
+	}
+	args := mtype.In(skip + 2)
+	if args.Kind() != reflect.Ptr || !isExportedOrBuiltin(args) {
+		return nil, fmt.Errorf("rpc: %s args must be an exported pointer, got %s", method.Name, args)
+	}
+	if mtype.NumOut() != 1 || mtype.Out(0) != typeOfOsError {
+		return nil, fmt.Errorf("rpc: %s must return error only", method.Name)
+	}
+	return &serviceMethod{
+		method:   method,
+		argsType: args.Elem(),
+		required: requiredFields(args.Elem()),
+		writes:   true,
+	}, nil
+}
+
+// registerFunc adds a standalone function to the map, under a method name
+// in dotted notation as in "Service.Method". Functions registered under the
+// same service name are grouped in a service without receiver.
+func (m *serviceMap) registerFunc(name string, fn interface{}) error {
+	method, err := newFuncMethod(name, fn)
+	if err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.addFuncLocked(name, method)
+}
+
+// registerFuncs adds standalone functions to the map as registerFunc does.
+// If any of the functions cannot be added, none is.
+func (m *serviceMap) registerFuncs(funcs map[string]interface{}) error {
+	names := make([]string, 0, len(funcs))
+	for name := range funcs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	methods := make([]*serviceMethod, len(names))
+	for i, name := range names {
+		method, err := newFuncMethod(name, funcs[name])
+		if err != nil {
+			return err
 		}
-		s.methods[method.Name] = &serviceMethod{
-			method:    method,
-			argsType:  args.Elem(),
-			replyType: reply.Elem(),
+		methods[i] = method
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	// Keep the services replaced by the functions, to restore them if any
+	// function cannot be added.
+	old := make(map[string]*service)
+	for _, name := range names {
+		serviceName, _, _ := splitMethod(name)
+		old[serviceName] = m.services[serviceName]
+	}
+	for i, name := range names {
+		if err := m.addFuncLocked(name, methods[i]); err != nil {
+			for serviceName, s := range old {
+				if s != nil {
+					m.services[serviceName] = s
+				} else {
+					delete(m.services, serviceName)
+				}
+			}
+			return err
 		}
 	}
-	if len(s.methods) == 0 {
-		return fmt.Errorf("rpc: %q has no exported methods of suitable type",
-			s.name)
+	return nil
+}
+
+// newFuncMethod returns the method of a standalone function registered
+// under a method name in dotted notation.
+func newFuncMethod(name string, fn interface{}) (*serviceMethod, error) {
+	if _, _, ok := splitMethod(name); !ok {
+		return nil, fmt.Errorf("rpc: function name ill-formed: %q", name)
+	}
+	f := reflect.ValueOf(fn)
+	if f.Kind() != reflect.Func {
+		return nil, fmt.Errorf("rpc: %q is not a function", name)
 	}
-	// Add to the map.
+	return newServiceMethod(reflect.Method{Name: name, Type: f.Type(), Func: f}, 0)
+}
+
+// addFuncLocked adds the method of a standalone function to the service
+// named in its method name, for callers holding the mutex.
+func (m *serviceMap) addFuncLocked(name string, method *serviceMethod) error {
+	serviceName, methodName, _ := splitMethod(name)
+	s := &service{
+		name:    serviceName,
+		methods: map[string]*serviceMethod{methodName: method},
+	}
+	old := m.services[s.name]
+	if old != nil {
+		if old.rcvr.IsValid() || old.builtin {
+			return fmt.Errorf("rpc: service already defined: %q", s.name)
+		}
+		if old.methods[methodName] != nil {
+			return fmt.Errorf("rpc: method already defined: %q", name)
+		}
+		for name, method := range old.methods {
+			s.methods[name] = method
+		}
+	}
+	return m.addLocked(s, old != nil)
+}
+
+// add adds a service to the map, optionally replacing a previously added
+// service of the same name, which is returned to be closed unless its
+// receiver is still registered, e.g. under an alias.
+func (m *serviceMap) add(s *service, replace bool) (replaced *service, err error) {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
+	old := m.services[s.name]
+	if err := m.addLocked(s, replace); err != nil {
+		return nil, err
+	}
+	if old != nil && !m.hasReceiverLocked(old) {
+		return old, nil
+	}
+	return nil, nil
+}
+
+// addLocked is add for callers holding the mutex.
+func (m *serviceMap) addLocked(s *service, replace bool) error {
+	if !s.builtin {
+		if err := m.checkBuiltin(s); err != nil {
+			return err
+		}
+	}
+	if !s.builtin && m.reserved != "" &&
+		(s.name == m.reserved || strings.HasPrefix(s.name, m.reserved+".")) {
+		return fmt.Errorf("rpc: service name %q is reserved", s.name)
+	}
 	if m.services == nil {
 		m.services = make(map[string]*service)
-	} else if _, ok := m.services[s.name]; ok {
+	} else if old, ok := m.services[s.name]; ok && (!replace || old.builtin) {
 		return fmt.Errorf("rpc: service already defined: %q", s.name)
 	}
+	if m.fold {
+		for name := range m.services {
+			if name != s.name && strings.EqualFold(name, s.name) {
+				return fmt.Errorf("rpc: service %q differs only by case from %q", s.name, name)
+			}
+		}
+		for name := range s.methods {
+			for other := range s.methods {
+				if name < other && strings.EqualFold(name, other) {
+					return fmt.Errorf("rpc: method %q differs only by case from %q", s.name+"."+name, s.name+"."+other)
+				}
+			}
+		}
+	}
+	for _, method := range s.methods {
+		if method.argsType == typeOfRawBody {
+			m.raw = true
+		}
+	}
 	m.services[s.name] = s
 	return nil
 }
 
+// hasRawArgs returns true if a method whose args are a RawBody was ever
+// added to the map.
+func (m *serviceMap) hasRawArgs() bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.raw
+}
+
+// checkBuiltin returns an error if a method of the service has the name of a
+// built-in method, ignoring case.
+func (m *serviceMap) checkBuiltin(s *service) error {
+	for builtinName, builtin := range m.services {
+		if !builtin.builtin || !strings.EqualFold(builtinName, s.name) {
+			continue
+		}
+		for name := range s.methods {
+			for other := range builtin.methods {
+				if strings.EqualFold(name, other) {
+					return fmt.Errorf("rpc: method %q collides with built-in method %q, rename it",
+						s.name+"."+name, builtinName+"."+other)
+				}
+			}
+		}
+	}
+	return nil
+}
+
 // get returns a registered service given a method name.
 //
 // The method name uses a dotted notation as in "Service.Method".
 func (m *serviceMap) get(method string) (*service, *serviceMethod, error) {
-	parts := strings.Split(method, ".")
-	if len(parts) != 2 {
+	serviceName, methodName, ok := splitMethod(method)
+	if !ok {
 		err := fmt.Errorf("rpc: service/method request ill-formed: %q", method)
 		return nil, nil, err
 	}
 	m.mutex.Lock()
-	service := m.services[parts[0]]
+	fold := m.fold
+	service := m.services[serviceName]
+	if service == nil && fold {
+		for name, s := range m.services {
+			if strings.EqualFold(name, serviceName) {
+				service = s
+				break
+			}
+		}
+	}
 	m.mutex.Unlock()
 	if service == nil {
-		err := fmt.Errorf("rpc: can't find service %q", method)
+		err := &notFoundError{fmt.Sprintf("rpc: can't find service %q", method)}
 		return nil, nil, err
 	}
-	serviceMethod := service.methods[parts[1]]
+	serviceMethod := service.methods[methodName]
+	if serviceMethod == nil && fold {
+		for name, sm := range service.methods {
+			if strings.EqualFold(name, methodName) {
+				serviceMethod = sm
+				break
+			}
+		}
+	}
 	if serviceMethod == nil {
-		err := fmt.Errorf("rpc: can't find method %q", method)
+		err := &notFoundError{fmt.Sprintf("rpc: can't find method %q", method)}
 		return nil, nil, err
 	}
 	return service, serviceMethod, nil
 }
 
+// suggest returns the registered method names closest to a method name,
+// which are at most a few edits away from it.
+func (m *serviceMap) suggest(method string) []string {
+	const maxDistance = 3
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var names []string
+	best := maxDistance + 1
+	for _, s := range m.services {
+		for name := range s.methods {
+			name = s.name + "." + name
+			d := levenshtein(method, name)
+			if d < best {
+				best, names = d, nil
+			}
+			if d == best {
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// levenshtein returns the edit distance between two strings.
+func levenshtein(a, b string) int {
+	s, t := []rune(a), []rune(b)
+	prev := make([]int, len(t)+1)
+	curr := make([]int, len(t)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(s); i++ {
+		curr[0] = i
+		for j := 1; j <= len(t); j++ {
+			cost := 1
+			if s[i-1] == t[j-1] {
+				cost = 0
+			}
+			curr[j] = prev[j-1] + cost
+			if d := prev[j] + 1; d < curr[j] {
+				curr[j] = d
+			}
+			if d := curr[j-1] + 1; d < curr[j] {
+				curr[j] = d
+			}
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(t)]
+}
+
+// len returns the number of registered services, not counting the
+// built-in ones.
+func (m *serviceMap) len() (n int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, s := range m.services {
+		if !s.builtin {
+			n++
+		}
+	}
+	return
+}
+
+// describe returns the descriptions of all registered methods, sorted by
+// name.
+func (m *serviceMap) describe() []MethodDescription {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var descs []MethodDescription
+	for _, s := range m.services {
+		for name, method := range s.methods {
+			descs = append(descs, MethodDescription{
+				Name:  s.name + "." + name,
+				Args:  zeroJSON(method.argsType),
+				Reply: zeroJSON(method.replyType),
+			})
+		}
+	}
+	sort.Sort(byName(descs))
+	return descs
+}
+
+// splitMethod splits a method name in dotted notation into its service and
+// method names, at the last dot, as service names may be dotted themselves,
+// e.g. "Admin.Users.Create". It returns false if the name is ill-formed.
+func splitMethod(method string) (service, name string, ok bool) {
+	i := strings.LastIndex(method, ".")
+	if i < 0 || !validServiceName(method[:i]) || i == len(method)-1 {
+		return "", "", false
+	}
+	return method[:i], method[i+1:], true
+}
+
+// validServiceName returns true if a service name has no empty dotted
+// segment.
+func validServiceName(name string) bool {
+	return name != "" && name[0] != '.' && name[len(name)-1] != '.' &&
+		!strings.Contains(name, "..")
+}
+
 // isExported returns true of a string is an exported (upper case) name.
 func isExported(name string) bool {
 	rune, _ := utf8.DecodeRuneInString(name)
@@ -166,3 +792,29 @@ func isExportedOrBuiltin(t reflect.Type) bool {
 	// so we need to check the type name as well.
 	return isExported(t.Name()) || t.PkgPath() == ""
 }
+
+// requiredFields returns the indices of the exported fields of a struct
+// tagged rpc:"required".
+func requiredFields(t reflect.Type) []int {
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+	var fields []int
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath == "" && field.Tag.Get("rpc") == "required" {
+			fields = append(fields, i)
+		}
+	}
+	return fields
+}
+
+// isZero returns true if v holds the zero value of its type, e.g. a nil
+// pointer or an empty string.
+func isZero(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface, reflect.Slice, reflect.Map, reflect.Chan, reflect.Func:
+		return v.IsNil()
+	}
+	return reflect.DeepEqual(v.Interface(), reflect.Zero(v.Type()).Interface())
+}
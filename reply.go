@@ -0,0 +1,113 @@
+// Copyright 2013 X-Formation. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+)
+
+// RawResponder is implemented by replies written verbatim to the client,
+// bypassing the codec, such as pre-rendered documents or images.
+//
+// The server only writes a RawResponder when the method call succeeds.
+type RawResponder interface {
+	// Content type of the response body.
+	ContentType() string
+	// Response body.
+	Body() []byte
+}
+
+// StatusCoder is implemented by replies choosing the HTTP status of a
+// successful response, e.g. 201 or 202. Without it, the status is 200.
+//
+// The status is ignored when the method call returns an error.
+type StatusCoder interface {
+	StatusCode() int
+}
+
+// HTTPStatuser is implemented by errors returned by methods to choose the
+// HTTP status of the response, e.g. 404 for a missing resource. The error is
+// still encoded by the codec.
+type HTTPStatuser interface {
+	HTTPStatus() int
+}
+
+// ErrAccepted is returned by methods which start work completing in the
+// background, to respond with a 202 rather than a 200. The reply, e.g. a
+// token to track the work with, is still encoded by the codec as that of a
+// successful call, and the call is reported as successful.
+var ErrAccepted = errors.New("rpc: request accepted")
+
+// RenderedError is an error returned by methods to send a response body
+// verbatim, with the given status and content type, instead of the error
+// encoded by the codec, e.g. to answer in a format set by a legacy client.
+type RenderedError struct {
+	// HTTP status of the response, or 500 if zero.
+	Status int
+	// Content type of the response body.
+	ContentType string
+	// Response body.
+	Body []byte
+}
+
+// Error returns the response body.
+func (e *RenderedError) Error() string {
+	return string(e.Body)
+}
+
+// writeRendered writes a RenderedError.
+func writeRendered(w http.ResponseWriter, e *RenderedError) error {
+	status := e.Status
+	if status == 0 {
+		status = 500
+	}
+	w.Header().Set("Content-Type", e.ContentType)
+	w.WriteHeader(status)
+	_, err := w.Write(e.Body)
+	return err
+}
+
+// Warner is implemented by replies of methods which succeed partially, to
+// report non-fatal warnings along with the result. Codecs may send the
+// warnings apart from the result, without failing the call.
+type Warner interface {
+	Warnings() []string
+}
+
+// Void is the reply type of methods which return nothing but an error, as
+// in:
+//
+//	func (t *T) Method(r *http.Request, args *Args, reply *rpc.Void) error
+//
+// Codecs may omit the result from the responses of such methods.
+type Void struct{}
+
+// IsVoid returns true if the reply is a Void or a pointer to a Void.
+func IsVoid(reply interface{}) bool {
+	switch reply.(type) {
+	case Void, *Void:
+		return true
+	}
+	return false
+}
+
+// writeRaw writes a RawResponder reply.
+func writeRaw(w http.ResponseWriter, raw RawResponder) error {
+	w.Header().Set("Content-Type", raw.ContentType())
+	_, err := w.Write(raw.Body())
+	return err
+}
+
+// callWriter invokes a method writing the response itself. If the method
+// fails before writing anything, the server responds with a 500.
+func (s *Server) callWriter(w *responseWriter, r *http.Request, service *service, method *serviceMethod, args reflect.Value) error {
+	_, errResult, _ := s.call(r, nil, service, method, args, reflect.ValueOf(w))
+	if errResult != nil && !w.wroteHeader {
+		s.writeError(w, r, 500, errResult.Error())
+	}
+	return errResult
+}
@@ -7,12 +7,20 @@
 package rpc
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"reflect"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // ----------------------------------------------------------------------------
@@ -26,32 +34,124 @@ type Codec interface {
 
 // CodecRequest decodes a request and encodes a response using a specific
 // serialization scheme.
+//
+// The server only reads the request body itself for the args of methods
+// taking a RawBody, once the codec returned the method name. The codec
+// decides where the method name comes from, e.g. the body or a header.
 type CodecRequest interface {
-	// Reads request and returns the RPC method name.
+	// Reads request and returns the RPC method name. It is called before
+	// ReadRequest, unless the method is known beforehand, as for
+	// Server.MethodHandler.
 	Method() (string, error)
 	// Reads request filling the RPC method args.
 	ReadRequest(interface{}) error
 	// Writes response using the RPC method reply. The error parameter is
 	// the error returned by the method call, if any.
+	//
+	// The response header is sent with the first write to the body, so the
+	// codec may set any header, e.g. Content-Type, before writing it. The
+	// server sets its own headers before calling WriteResponse and does not
+	// change headers set by the codec.
+	//
+	// The response may vary with the request headers, e.g. to indent it for
+	// humans, as codec requests may retain the *http.Request they were
+	// created for by Codec.NewRequest.
 	WriteResponse(http.ResponseWriter, interface{}, error) error
 }
 
+// ErrorWriter is implemented by codecs able to encode an error for requests
+// the codec did not read, e.g. requests with a wrong HTTP method. The server
+// then writes the errors it responds with through the codec, rather than as
+// plain text. Codec requests may implement it too, for the errors responding
+// to the requests they read to carry what was decoded, e.g. the request id.
+type ErrorWriter interface {
+	// Writes the error as a response with the given HTTP status.
+	WriteError(w http.ResponseWriter, status int, err error) error
+}
+
+// ResponseEncoder is implemented by codecs able to encode responses to
+// requests decoded by other codecs, e.g. for services registered with
+// RegisterServiceWithCodec or requests naming the codec in their
+// ResponseCodecHeader. Such responses are otherwise written by a
+// CodecRequest of the codec, created once the request body was read.
+type ResponseEncoder interface {
+	// Writes response using the RPC method reply, as
+	// CodecRequest.WriteResponse does.
+	EncodeResponse(w http.ResponseWriter, reply interface{}, methodErr error) error
+}
+
+// MethodNotFoundWriter is implemented by codec requests rendering the
+// responses to requests for methods which are not registered in the format
+// of the codec, e.g. as a structured error object. The server otherwise
+// writes such errors as those of the requests it rejects itself, with a 404.
+type MethodNotFoundWriter interface {
+	// Writes the response, including its HTTP status, for the requested
+	// method. The error describes why the method was not found.
+	WriteMethodNotFound(w http.ResponseWriter, method string, err error) error
+}
+
+// Validator is implemented by method args able to validate themselves.
+//
+// The server calls Validate after decoding the args and, if it returns an
+// error, responds with a 400 encoded by the codec without calling the method.
+type Validator interface {
+	Validate() error
+}
+
 // ----------------------------------------------------------------------------
 // Server
 // ----------------------------------------------------------------------------
 
+// interfaceAddrs lists the addresses of the local interfaces.
+var interfaceAddrs = net.InterfaceAddrs
+
 var (
+	// ErrEmptyBindLocal is no longer returned, as BindLocal always accepts
+	// loopback addresses.
 	ErrEmptyBindLocal    = errors.New("rpc: local address list is empty")
 	ErrMalformedRemoteIp = errors.New("rpc: remote client rejected, cannot read its IP")
 	ErrRemoteNotAllowed  = errors.New("rpc: remote client rejected, not allowed by the server")
+	ErrTimeout           = errors.New("rpc: method call timed out")
+	ErrServerBusy        = errors.New("rpc: too many concurrent requests")
+	ErrDraining          = errors.New("rpc: server is shutting down")
+	ErrReadTimeout       = errors.New("rpc: request body read timed out")
+	ErrNoCodecs          = errors.New("rpc: no codecs registered")
+	ErrBodyTooLarge      = errors.New("rpc: request body too large")
+	ErrDuplicateRequest  = errors.New("rpc: request with the same idempotency key in progress")
+	ErrClientBusy        = errors.New("rpc: too many concurrent requests from the client")
+	ErrTLSRequired       = errors.New("rpc: remote client rejected, TLS connection required")
 )
 
+// StatusClientClosedRequest is the status reported to the metrics observer
+// and after functions for requests whose client went away before the method
+// call completed. No response is written for such requests.
+const StatusClientClosedRequest = 499
+
+// TimeoutHeader is the request header a client may set to the duration it
+// is willing to wait for the method call to complete, e.g. "2s".
+const TimeoutHeader = "X-RPC-Timeout"
+
+// ResponseCodecHeader is the request header a client may set to the content
+// type of a registered codec, to get the response encoded by that codec
+// rather than by the codec decoding the request, e.g. for debugging. Only
+// codecs implementing ResponseEncoder can encode such responses: other
+// content types, as well as unregistered ones, are ignored. Naming the codec
+// decoding the request has it respond as usual, e.g. with the request id.
+const ResponseCodecHeader = "X-RPC-Response-Codec"
+
+// VersionHeader is the request header a client may set to the version of
+// the API it uses, for codecs to choose how to decode its requests.
+const VersionHeader = "X-API-Version"
+
 // NewServer returns a new RPC server.
 func NewServer() *Server {
-	return &Server{
+	s := &Server{
 		codecs:   make(map[string]Codec),
-		services: new(serviceMap),
+		services: &serviceMap{reserved: BuiltinService},
+		gzipMin:  -1,
 	}
+	s.services.registerBuiltin(&builtinService{s.services}, BuiltinService)
+	return s
 }
 
 // Server serves registered RPC services using registered codecs.
@@ -59,6 +159,39 @@ type Server struct {
 	codecs   map[string]Codec
 	services *serviceMap
 	filters  []func(net.IP) bool
+	observer func(method string, status int, latency time.Duration, err error)
+	timeout  time.Duration
+	logger   Logger
+	debug    bool
+	before   []func(*RequestInfo) error
+	after    []func(*RequestInfo)
+	slots    chan struct{}
+	canceled func(*RequestInfo)
+	redacted map[string]map[string]bool
+	errors   TransportErrorFormat
+	query    map[string]bool
+	sizes    func(method string, read, written int64)
+	acl      map[string][]*net.IPNet
+	drainMu  sync.Mutex
+	draining bool
+	inflight sync.WaitGroup
+	gzipMin  int
+	callInfo bool
+	fallback string
+	readTime time.Duration
+	active   int32
+	sniff    bool
+	headers  http.Header
+	reqID    bool
+	limits   map[string]int64
+	defCodec string
+	idem     *idempotencyStore
+	perIP    int
+	ipMutex  sync.Mutex
+	ipActive map[string]int
+	proxies  []*net.IPNet
+	certs    func(*tls.ConnectionState) error
+	rewriter func(method string) string
 }
 
 // RegisterCodec adds a new codec to the server.
@@ -67,13 +200,56 @@ type Server struct {
 // XML. A codec is chosen based on the "Content-Type" header from the request,
 // excluding the charset definition.
 func (s *Server) RegisterCodec(codec Codec, contentType string) {
-	s.codecs[strings.ToLower(contentType)] = codec
+	s.codecs[mediaType(contentType)] = codec
+}
+
+// SetDefaultCodec makes the server decode the requests sent without a
+// Content-Type header with the codec registered for the given content type,
+// instead of rejecting them with a 415. Requests with an unrecognized
+// Content-Type are still rejected. An empty content type removes the
+// default.
+func (s *Server) SetDefaultCodec(contentType string) {
+	s.defCodec = mediaType(contentType)
+}
+
+// requestContentType returns the media type of the request Content-Type, or
+// the default codec content type if the header is missing.
+func (s *Server) requestContentType(r *http.Request) string {
+	if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		return mediaType(contentType)
+	}
+	return s.defCodec
+}
+
+// SetCodecMaxBytes limits the size of the request bodies decoded by the
+// codec registered for the given content type. Larger requests are rejected
+// with a 413. A value of 0 or less removes the limit.
+func (s *Server) SetCodecMaxBytes(contentType string, n int64) {
+	if s.limits == nil {
+		s.limits = make(map[string]int64)
+	}
+	if n > 0 {
+		s.limits[mediaType(contentType)] = n
+	} else {
+		delete(s.limits, mediaType(contentType))
+	}
+}
+
+// MustHaveCodec panics if no codec is registered, e.g. to catch a
+// misconfigured server at startup rather than when serving requests, which
+// fail with a 500 and ErrNoCodecs.
+func (s *Server) MustHaveCodec() {
+	if len(s.codecs) == 0 {
+		panic(ErrNoCodecs)
+	}
 }
 
 // RegisterService adds a new service to the server.
 //
 // The name parameter is optional: if empty it will be inferred from
-// the receiver type name.
+// the receiver type name. It may be dotted to namespace the service, e.g.
+// methods of a service registered as "Admin.Users" are called as in
+// "Admin.Users.Create".
 //
 // Methods from the receiver will be extracted if these rules are satisfied:
 //
@@ -85,9 +261,135 @@ func (s *Server) RegisterCodec(codec Codec, contentType string) {
 //    - The second and third arguments are exported or local.
 //    - The method has return type error.
 //
-// All other methods are ignored.
+// The args and reply may point to structs as well as to slices or maps.
+// Requests whose args leave fields tagged rpc:"required" to their zero value,
+// e.g. a nil pointer, are rejected with a 400 before the method is called.
+// Args pointing to a RawBody receive the request body without decoding.
+//
+// Alternatively, a method may omit the *reply argument and return the reply
+// instead, as in:
+//
+//    func (t *T) Method(r *http.Request, args *Args) (Reply, error)
+//
+// where the Reply type is exported or local. A method may also take a Stream
+// instead of the *reply argument to send its results incrementally.
+//
+// As an escape hatch, a method may write the response itself, e.g. to send
+// server-sent events, when its signature is:
+//
+//    func (t *T) Method(w http.ResponseWriter, r *http.Request, args *Args) error
+//
+// Its response is not encoded by the codec.
+//
+// Registration fails with an error naming the offending argument if an
+// exported method takes a *http.Request or http.ResponseWriter first, as RPC
+// methods do, but breaks any other rule. All other methods are ignored.
+//
+// Methods declared on both value and pointer receivers are extracted. When
+// the receiver is passed by value, the server calls the methods on a pointer
+// to its own copy of the value.
+//
+// Registering a service under an already registered name returns an error;
+// use ReplaceService to deliberately override a service.
 func (s *Server) RegisterService(receiver interface{}, name string) error {
-	return s.services.register(receiver, name)
+	return s.services.register(receiver, name, serviceOptions{})
+}
+
+// RegisterServiceAliases adds a service to the server under each of the
+// given names, e.g. to keep serving it under a former name. The receiver is
+// inspected once, following the rules of RegisterService, which also infer
+// the first name if it is empty. The other names must not be empty.
+//
+// If any of the names cannot be registered, none is and an error is
+// returned.
+func (s *Server) RegisterServiceAliases(receiver interface{}, names ...string) error {
+	return s.services.registerAliases(receiver, names)
+}
+
+// RegisterFunc adds a standalone function to the server under a method name
+// in dotted notation, as in "Service.Method".
+//
+// The function must follow the signature rules of service methods, that is
+// func(*http.Request, *args, *reply) error or
+// func(*http.Request, *args) (reply, error). Functions registered under the
+// same service name are grouped together, but cannot be added to a service
+// registered with RegisterService.
+func (s *Server) RegisterFunc(name string, fn interface{}) error {
+	return s.services.registerFunc(name, fn)
+}
+
+// RegisterFuncs adds standalone functions to the server as RegisterFunc
+// does, each under the method name it is mapped to.
+//
+// If any of the functions cannot be registered, none is and an error is
+// returned.
+func (s *Server) RegisterFuncs(funcs map[string]interface{}) error {
+	return s.services.registerFuncs(funcs)
+}
+
+// ReplaceService adds a new service to the server, replacing the service
+// previously registered under the same name, if any. The replaced receiver
+// is closed if it is a Closer, unless it remains registered under another
+// name, and the error of its Close method is returned.
+//
+// The receiver and name parameters follow the RegisterService rules.
+func (s *Server) ReplaceService(receiver interface{}, name string) error {
+	return s.services.register(receiver, name, serviceOptions{replace: true})
+}
+
+// RegisterServiceWithCodec adds a new service to the server, whose responses
+// are always encoded by the given codec regardless of the request
+// "Content-Type" header.
+//
+// Requests to the service are still decoded by the codec registered for
+// their content type. The CodecRequest of the service codec is created once
+// the request body was read, so it must not depend on the body to write
+// responses.
+//
+// The receiver and name parameters follow the RegisterService rules.
+func (s *Server) RegisterServiceWithCodec(receiver interface{}, name string, codec Codec) error {
+	return s.services.register(receiver, name, serviceOptions{codec: codec})
+}
+
+// RegisterServiceWithNamer adds a new service to the server, exposing each
+// method under the name returned by namer for its Go method name, e.g. to
+// call the Multiply method as "Service.multiply".
+//
+// The receiver and name parameters follow the RegisterService rules.
+// Registration fails if namer maps two methods to the same name.
+func (s *Server) RegisterServiceWithNamer(receiver interface{}, name string, namer func(method string) string) error {
+	return s.services.register(receiver, name, serviceOptions{namer: namer})
+}
+
+// SetReservedPrefix sets the service name reserved to the methods built into
+// the server, "rpc" by default, which user services cannot be registered
+// under. Services named after the prefix itself or followed by a dot are
+// rejected. An empty prefix lifts the restriction.
+func (s *Server) SetReservedPrefix(prefix string) {
+	s.services.setReserved(prefix)
+}
+
+// SetNameInferrer sets the function inferring the name of the services
+// registered without one, from the type of their receiver, dereferenced if
+// it is a pointer. By default, the name of the type is used, which must be
+// exported.
+func (s *Server) SetNameInferrer(infer func(reflect.Type) string) {
+	s.services.setInferrer(infer)
+}
+
+// SetCaseInsensitiveMethods makes the server resolve method names ignoring
+// their case, so that "service1.multiply" calls "Service1.Multiply".
+//
+// Method names are case-sensitive by default. While the option is on,
+// registering services or methods whose names differ only by case fails.
+func (s *Server) SetCaseInsensitiveMethods(on bool) {
+	s.services.setFold(on)
+}
+
+// SetDebug makes the server include hints meant for developers in its error
+// responses, such as the registered methods closest to an unknown method.
+func (s *Server) SetDebug(debug bool) {
+	s.debug = debug
 }
 
 // HasMethod returns true if the given method is registered.
@@ -100,6 +402,47 @@ func (s *Server) HasMethod(method string) bool {
 	return false
 }
 
+// MethodInfo returns the types of the args and reply of a registered method,
+// e.g. to generate schemas documenting it, and false if it is not registered.
+// The args type is the type pointed to by the method args, as is the reply
+// type unless the method returns its reply, whose type is then returned
+// as is. The reply type is nil for methods streaming their response or
+// writing it themselves.
+//
+// The method uses a dotted notation as in "Service.Method".
+func (s *Server) MethodInfo(method string) (argsType, replyType reflect.Type, ok bool) {
+	_, methodSpec, err := s.services.get(method)
+	if err != nil {
+		return nil, nil, false
+	}
+	return methodSpec.argsType, methodSpec.replyType, true
+}
+
+// HasCodec returns true if a codec is registered for the given content type.
+// As when serving requests, parameters such as the charset are ignored.
+func (s *Server) HasCodec(contentType string) bool {
+	_, ok := s.codecs[mediaType(contentType)]
+	return ok
+}
+
+// HealthHandler returns a handler reporting the server health, meant to be
+// probed by load balancers.
+//
+// The handler answers any HTTP method, bypasses the codec and the client IP
+// checks, and responds with 200 once at least one codec and one service
+// are registered, or 503 otherwise.
+func (s *Server) HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if len(s.codecs) == 0 || s.services.len() == 0 {
+			w.WriteHeader(503)
+			fmt.Fprint(w, "unavailable")
+			return
+		}
+		fmt.Fprint(w, "healthy")
+	})
+}
+
 // Bind makes the server to only accept requests comming from
 // specified IP addresses.
 func (s *Server) Bind(allow ...net.IP) {
@@ -115,11 +458,43 @@ func (s *Server) Bind(allow ...net.IP) {
 	}
 }
 
+// BindFunc makes the server to accept requests from clients for which allow
+// returns true, in addition to the addresses accepted by Bind and BindLocal.
+//
+// It suits allow lists which change at run time. The function may be called
+// concurrently and must be safe for concurrent use.
+func (s *Server) BindFunc(allow func(net.IP) bool) {
+	if allow != nil {
+		s.filters = append(s.filters, allow)
+	}
+}
+
+// RestrictMethod makes the server to only accept calls to the given method
+// from clients within the given networks, in addition to the restrictions
+// set with Bind. Calls from other clients are rejected with a 403.
+//
+// The method uses a dotted notation as in "Service.Method", and is matched
+// case-insensitively.
+func (s *Server) RestrictMethod(method string, allow ...*net.IPNet) {
+	if s.acl == nil {
+		s.acl = make(map[string][]*net.IPNet)
+	}
+	method = strings.ToLower(method)
+	s.acl[method] = append(s.acl[method], allow...)
+}
+
 // BindLocal makes the server to accept requests comming from
 // local IP only.
+//
+// Loopback addresses are always accepted, even on hosts whose loopback
+// interface is not listed among the interface addresses.
 func (s *Server) BindLocal() (err error) {
+	s.Bind(net.IPv4(127, 0, 0, 1), net.IPv6loopback)
+	s.filters = append(s.filters, func(ip net.IP) bool {
+		return ip.IsLoopback()
+	})
 	var addrs []net.Addr
-	if addrs, err = net.InterfaceAddrs(); err != nil {
+	if addrs, err = interfaceAddrs(); err != nil {
 		return
 	}
 	local := make([]net.IP, 0, len(addrs))
@@ -128,91 +503,735 @@ func (s *Server) BindLocal() (err error) {
 			local = append(local, ip)
 		}
 	}
-	if len(local) == 0 {
-		return ErrEmptyBindLocal
-	}
 	s.Bind(local...)
+	return
+}
+
+// privateNets are the private address ranges of RFC 1918, and their IPv6
+// counterpart of RFC 4193.
+var privateNets = mustParseCIDRs("10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7")
+
+// BindPrivate makes the server to accept requests comming from loopback and
+// private addresses, e.g. from a docker bridge network, in addition to the
+// addresses accepted by Bind and BindLocal.
+func (s *Server) BindPrivate() {
 	s.filters = append(s.filters, func(ip net.IP) bool {
-		return ip.IsLoopback()
+		if ip.IsLoopback() {
+			return true
+		}
+		for _, n := range privateNets {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+		return false
 	})
-	return
+}
+
+// TrustForwardedFor makes the server read the IP of clients calling through
+// proxies within the given networks from the X-Forwarded-For header, the
+// client IP being the last address it lists which is not a trusted proxy.
+// That IP is the one checked by Bind and RestrictMethod, counted by
+// SetMaxConcurrentPerIP, logged, and set in the CallInfo.
+//
+// Only trust proxies which set the header themselves, as clients can send
+// it with any address.
+func (s *Server) TrustForwardedFor(proxies ...*net.IPNet) {
+	s.proxies = append(s.proxies, proxies...)
+}
+
+// SetClientCertVerifier makes the server check the TLS connection state of
+// requests with the verifier, e.g. to authorize clients by the certificates
+// of their verified chains. Requests are rejected with a 403 if it returns an
+// error, or if they were not sent over TLS. The verifier is called after the
+// client IP is accepted.
+func (s *Server) SetClientCertVerifier(verifier func(*tls.ConnectionState) error) {
+	s.certs = verifier
+}
+
+// mustParseCIDRs parses networks in CIDR notation, panicking on errors.
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets[i] = n
+	}
+	return nets
+}
+
+// SetMaxConcurrent limits the number of requests served concurrently.
+// Requests received while the server is at capacity are rejected with a 503
+// instead of being queued. A value of 0, the default, means no limit.
+// Requests whose method call timed out keep counting until it returns, while
+// those of clients denied by Bind or the certificate checks never count.
+//
+// It must be called before the server starts serving requests.
+func (s *Server) SetMaxConcurrent(n int) {
+	if n > 0 {
+		s.slots = make(chan struct{}, n)
+	} else {
+		s.slots = nil
+	}
+}
+
+// SetMaxConcurrentPerIP limits the number of requests served concurrently
+// for each client IP address, so that a single client cannot take all the
+// slots allowed by SetMaxConcurrent. Requests received while their client is
+// at capacity are rejected with a 429. A value of 0, the default, means no
+// limit.
+//
+// It must be called before the server starts serving requests.
+func (s *Server) SetMaxConcurrentPerIP(n int) {
+	s.perIP = n
+	s.ipActive = make(map[string]int)
+}
+
+// acquireIP records a request in flight for the client IP address, unless
+// the client is at capacity. The returned function releases it.
+func (s *Server) acquireIP(r *http.Request, remote net.IP) (release func(), ok bool) {
+	ip := r.RemoteAddr
+	if remote != nil {
+		ip = remote.String()
+	}
+	s.ipMutex.Lock()
+	defer s.ipMutex.Unlock()
+	if s.ipActive[ip] >= s.perIP {
+		return nil, false
+	}
+	s.ipActive[ip]++
+	return func() {
+		s.ipMutex.Lock()
+		if s.ipActive[ip]--; s.ipActive[ip] == 0 {
+			delete(s.ipActive, ip)
+		}
+		s.ipMutex.Unlock()
+	}, true
+}
+
+// Drain makes the server reject new requests with a 503, while the requests
+// already being served are completed. Use Wait to wait for their completion.
+func (s *Server) Drain() {
+	s.drainMu.Lock()
+	s.draining = true
+	s.drainMu.Unlock()
+}
+
+// Wait blocks until all requests in flight are served, and the method calls
+// which timed out returned. It is meant to be called after Drain, e.g. while
+// shutting down an http.Server.
+func (s *Server) Wait() {
+	s.inflight.Wait()
+}
+
+// begin records a request in flight, unless the server is draining.
+func (s *Server) begin() bool {
+	s.drainMu.Lock()
+	defer s.drainMu.Unlock()
+	if s.draining {
+		return false
+	}
+	s.inflight.Add(1)
+	return true
+}
+
+// InFlight returns the number of requests being served, including those
+// whose method call timed out but still runs.
+func (s *Server) InFlight() int {
+	return int(atomic.LoadInt32(&s.active))
+}
+
+// SetMetricsObserver registers a function called at the end of every
+// request served, including requests rejected before reaching a method.
+//
+// The method parameter is empty when the request failed before the method
+// name could be resolved. The err parameter is the error which caused the
+// request to fail, or the error returned by the method call, if any.
+func (s *Server) SetMetricsObserver(observer func(method string, status int, latency time.Duration, err error)) {
+	s.observer = observer
+}
+
+// SetSizeObserver registers a function called at the end of every request
+// served with the number of bytes read from the request body and written in
+// the response body.
+//
+// The method parameter is empty when the request failed before the method
+// name could be resolved.
+func (s *Server) SetSizeObserver(observer func(method string, read, written int64)) {
+	s.sizes = observer
+}
+
+// SetReadTimeout bounds the time allowed to read the request body, measured
+// from the start of the request. Requests whose body is not read in time are
+// rejected with a 408. A zero duration, the default, means no limit.
+func (s *Server) SetReadTimeout(timeout time.Duration) {
+	s.readTime = timeout
+}
+
+// SetMaxTimeout caps the duration clients may request with the TimeoutHeader.
+// A zero duration, the default, leaves the requested durations uncapped.
+func (s *Server) SetMaxTimeout(timeout time.Duration) {
+	s.timeout = timeout
 }
 
 // ServeHTTP
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if err := s.clientAllowed(r.RemoteAddr); err != nil {
-		writeError(w, 403, err.Error())
-		return
+	s.handle(w, r, "")
+}
+
+// MethodHandler returns a handler calling a single method, which is not
+// read from the request, e.g. to mount the method at its own URL path:
+//
+//    h, err := s.MethodHandler("Service.Method")
+//    // [...]
+//    http.Handle("/service/method", h)
+//
+// The method uses a dotted notation as in "Service.Method".
+func (s *Server) MethodHandler(method string) (http.Handler, error) {
+	if _, _, err := s.services.get(method); err != nil {
+		return nil, err
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.handle(w, r, method)
+	}), nil
+}
+
+// SetMethodRewriter sets a function rewriting the method names read from
+// requests before the methods are looked up, e.g. to keep serving clients
+// calling deprecated names under the current ones, without registering the
+// services twice. The rewriter returns the method names it leaves untouched
+// as is. The methods of MethodHandler handlers are not rewritten.
+//
+// The method uses a dotted notation as in "Service.Method".
+func (s *Server) SetMethodRewriter(rewriter func(method string) string) {
+	s.rewriter = rewriter
+}
+
+// SetFallbackMethod sets a method called instead of the methods requested
+// but not registered, which are otherwise rejected. The fallback method can
+// read the requested method name with RequestedMethod. An empty method
+// removes the fallback.
+//
+// The method uses a dotted notation as in "Service.Method".
+func (s *Server) SetFallbackMethod(method string) error {
+	if method != "" {
+		if _, _, err := s.services.get(method); err != nil {
+			return err
+		}
+	}
+	s.fallback = method
+	return nil
+}
+
+// handle serves a request to the given method, or to the method read from
+// the request if empty.
+func (s *Server) handle(w http.ResponseWriter, r *http.Request, method string) {
+	start := time.Now()
+	rw := &responseWriter{ResponseWriter: w}
+	state := &requestState{method: method}
+	defer state.release()
+	atomic.AddInt32(&s.active, 1)
+	state.onRelease(func() { atomic.AddInt32(&s.active, -1) })
+	state.ip, state.ipErr = s.clientIP(r)
+	if s.reqID {
+		var id string
+		r, id = withRequestID(r)
+		rw.Header().Set(RequestIDHeader, id)
+	}
+	if s.readTime > 0 && r.Body != nil {
+		state.body = &timeoutReader{ReadCloser: r.Body, deadline: start.Add(s.readTime)}
+		r.Body = state.body
+	}
+	if s.sniff && r.Body != nil {
+		r.Body = &sniffReader{ReadCloser: r.Body}
+	}
+	var body *countingReader
+	if s.sizes != nil && r.Body != nil {
+		body = &countingReader{ReadCloser: r.Body}
+		r.Body = body
+	}
+	err := s.serve(rw, r, state)
+	if !rw.wroteHeader && err != context.Canceled {
+		rw.WriteHeader(rw.Status())
+	}
+	latency := time.Since(start)
+	if s.observer != nil {
+		s.observer(state.method, rw.Status(), latency, err)
+	}
+	if s.sizes != nil {
+		var read int64
+		if body != nil {
+			read = body.n
+		}
+		s.sizes(state.method, read, rw.written)
+	}
+	if s.logger != nil {
+		s.logRequest(r, state, rw.Status(), latency)
+	}
+	if state.service != nil && len(s.after) > 0 {
+		info := state.info(r)
+		info.Error = err
+		info.StatusCode = rw.Status()
+		for _, f := range s.after {
+			f(info)
+		}
+	}
+}
+
+// requestState holds what is known about a request as it is served.
+type requestState struct {
+	method  string         // resolved RPC method name
+	service *service       // resolved service
+	args    reflect.Value  // decoded method args
+	ip      net.IP         // client IP, nil if it cannot be read
+	ipErr   error          // error reading the client IP, if any
+	body    *timeoutReader // request body, if its reading is timed
+	limit   *limitReader   // request body, if its size is limited
+
+	mutex    sync.Mutex
+	releases []func() // release the server resources held by the request
+	running  bool     // method call still running
+	served   bool     // response served
+}
+
+// onRelease adds a function releasing a server resource held by the request,
+// once it is served and its method call returned.
+func (state *requestState) onRelease(f func()) {
+	state.releases = append(state.releases, f)
+}
+
+// release runs the release functions once the request is served, unless its
+// method call outlived it, e.g. past a timeout, which then runs them when it
+// returns.
+func (state *requestState) release() {
+	state.mutex.Lock()
+	state.served = true
+	running := state.running
+	state.mutex.Unlock()
+	if !running {
+		state.runReleases()
+	}
+}
+
+// callStarted records that the method call runs apart from the request. The
+// returned function must be called when the call returns.
+func (state *requestState) callStarted() (returned func()) {
+	state.mutex.Lock()
+	state.running = true
+	state.mutex.Unlock()
+	return func() {
+		state.mutex.Lock()
+		state.running = false
+		served := state.served
+		state.mutex.Unlock()
+		if served {
+			state.runReleases()
+		}
+	}
+}
+
+// runReleases runs the release functions, in reverse order of addition.
+func (state *requestState) runReleases() {
+	for i := len(state.releases) - 1; i >= 0; i-- {
+		state.releases[i]()
+	}
+}
+
+// readError returns the status and error to respond with when the codec
+// fails to read the request.
+func (state *requestState) readError(err error) (int, error) {
+	if state.body != nil && state.body.timedOut {
+		return 408, ErrReadTimeout
+	}
+	if state.limit != nil && state.limit.exceeded {
+		return 413, ErrBodyTooLarge
+	}
+	return 400, err
+}
+
+// serve processes a single request, filling the state as the request is
+// resolved, or using the method already set in the state. It returns the
+// error which caused the request to fail, or the error returned by the
+// method call, if any.
+func (s *Server) serve(w *responseWriter, r *http.Request, state *requestState) (err error) {
+	if !s.begin() {
+		s.writeError(w, r, 503, ErrDraining.Error())
+		return ErrDraining
+	}
+	state.onRelease(s.inflight.Done)
+	// Denied clients are rejected before they can use up a slot.
+	if err := s.clientAllowed(state.ip, state.ipErr); err != nil {
+		s.writeError(w, r, 403, err.Error())
+		return err
+	}
+	if err := s.certAllowed(r); err != nil {
+		s.writeError(w, r, 403, err.Error())
+		return err
+	}
+	if s.slots != nil {
+		select {
+		case s.slots <- struct{}{}:
+			state.onRelease(func() { <-s.slots })
+		default:
+			w.Header().Set("Retry-After", "1")
+			s.writeError(w, r, 503, ErrServerBusy.Error())
+			return ErrServerBusy
+		}
+	}
+	if s.perIP > 0 {
+		release, ok := s.acquireIP(r, state.ip)
+		if !ok {
+			w.Header().Set("Retry-After", "1")
+			s.writeError(w, r, 429, ErrClientBusy.Error())
+			return ErrClientBusy
+		}
+		state.onRelease(release)
+	}
+	if r.Method == "OPTIONS" {
+		s.writeOptions(w)
+		return nil
 	}
 	if r.Method != "POST" {
-		writeError(w, 405, "rpc: POST method required, received "+r.Method)
-		return
+		err := errors.New("rpc: POST method required, received " + r.Method)
+		w.Header().Set("Allow", strings.Join(s.allowedMethods(), ", "))
+		s.writeError(w, r, 405, err.Error())
+		return err
 	}
-	contentType := r.Header.Get("Content-Type")
-	idx := strings.Index(contentType, ";")
-	if idx != -1 {
-		contentType = contentType[:idx]
+	if len(s.codecs) == 0 {
+		s.writeError(w, r, 500, ErrNoCodecs.Error())
+		return ErrNoCodecs
 	}
-	codec := s.codecs[strings.ToLower(contentType)]
+	contentType := s.requestContentType(r)
+	codec := s.codecs[contentType]
 	if codec == nil {
-		writeError(w, 415, "rpc: unrecognized Content-Type: "+contentType)
-		return
+		err := errors.New("rpc: unrecognized Content-Type: " + contentType)
+		s.writeError(w, r, 415, err.Error())
+		return err
 	}
-	// Create a new codec request.
-	codecReq := codec.NewRequest(r)
-	// Get service method to be called.
-	method, errMethod := codecReq.Method()
-	if errMethod != nil {
-		writeError(w, 400, errMethod.Error())
-		return
+	if limit, ok := s.limits[contentType]; ok && r.Body != nil {
+		if r.ContentLength > limit {
+			s.writeError(w, r, 413, ErrBodyTooLarge.Error())
+			return ErrBodyTooLarge
+		}
+		state.limit = &limitReader{ReadCloser: r.Body, n: limit}
+		r.Body = state.limit
+	}
+	// Requests with an idempotency key are checked against the cache once
+	// their method is resolved and allowed, which requires hashing their
+	// body before the codec reads it.
+	var digest string
+	if s.idem != nil && r.Header.Get(IdempotencyKeyHeader) != "" {
+		var errHash error
+		if digest, errHash = hashBody(r); errHash != nil {
+			status, err := state.readError(errHash)
+			s.writeError(w, r, status, err.Error())
+			return err
+		}
+	}
+	// Create a new codec request, unless the method and args are read from
+	// the query.
+	codecReq := s.newQueryRequest(r, codec, state.method)
+	if r.Body != nil && s.services.hasRawArgs() {
+		r.Body = &recordingReader{ReadCloser: r.Body}
+	}
+	if codecReq == nil {
+		codecReq = codec.NewRequest(r)
+	}
+	// Get service method to be called, unless it was already set.
+	method := state.method
+	if method == "" {
+		var errMethod error
+		if method, errMethod = codecReq.Method(); errMethod != nil {
+			status, err := state.readError(errMethod)
+			s.writeRequestError(w, r, codecReq, status, err.Error())
+			return err
+		}
+		if s.rewriter != nil {
+			method = s.rewriter(method)
+		}
+		state.method = method
 	}
 	serviceSpec, methodSpec, errGet := s.services.get(method)
+	if errGet != nil && s.fallback != "" {
+		if fs, fm, err := s.services.get(s.fallback); err == nil {
+			serviceSpec, methodSpec, errGet = fs, fm, nil
+			r = withRequestedMethod(r, method)
+			method = s.fallback
+			state.method = method
+		}
+	}
+	state.service = serviceSpec
 	if errGet != nil {
-		writeError(w, 400, errGet.Error())
-		return
+		status, msg := 400, errGet.Error()
+		if _, ok := errGet.(*notFoundError); ok {
+			status = 404
+			if s.debug {
+				if names := s.services.suggest(method); len(names) > 0 {
+					msg += `; did you mean "` + strings.Join(names, `", "`) + `"?`
+				}
+			}
+			if nw, ok := codecReq.(MethodNotFoundWriter); ok {
+				if nw.WriteMethodNotFound(w, method, errors.New(msg)) == nil {
+					return errGet
+				}
+			}
+		}
+		s.writeRequestError(w, r, codecReq, status, msg)
+		return errGet
+	}
+	if err := s.methodAllowed(method, state.ip, state.ipErr); err != nil {
+		s.writeRequestError(w, r, codecReq, 403, err.Error())
+		return err
+	}
+	if digest != "" {
+		key := idempotencyKey(r, state, digest)
+		cached, ok := s.idem.start(key)
+		if !ok {
+			w.Header().Set("Retry-After", "1")
+			s.writeRequestError(w, r, codecReq, 409, ErrDuplicateRequest.Error())
+			return ErrDuplicateRequest
+		}
+		if cached != nil {
+			return s.replay(w, r, cached)
+		}
+		rec := &recordingWriter{ResponseWriter: w.ResponseWriter}
+		w.ResponseWriter = rec
+		defer func() { s.finishOnce(w, key, rec, err) }()
 	}
 	// Decode the args.
 	args := reflect.New(methodSpec.argsType)
-	if errRead := codecReq.ReadRequest(args.Interface()); errRead != nil {
-		writeError(w, 400, errRead.Error())
-		return
+	if errRead := s.readArgs(r, codecReq, method, args.Interface()); errRead != nil {
+		status, err := state.readError(errRead)
+		s.writeRequestError(w, r, codecReq, status, err.Error())
+		return err
+	}
+	state.args = args
+	named := mediaType(r.Header.Get(ResponseCodecHeader))
+	encoder, override := s.codecs[named].(ResponseEncoder)
+	switch {
+	case named == contentType:
+		// The client asked for the codec decoding the request, which
+		// responds with the request id as usual.
+	case override:
+		// The client asked for the response to be encoded by another codec.
+		codecReq = encoderRequest{encoder}
+	case serviceSpec.codec != nil:
+		// The service responds using its own codec.
+		codecReq = responseCodecRequest(serviceSpec.codec, r)
+	}
+	// Check the required fields of the args are set.
+	if missing := methodSpec.missing(args); len(missing) > 0 {
+		errMissing := errors.New("rpc: missing required fields: " + strings.Join(missing, ", "))
+		if errWrite := writeCodecError(w, codecReq, 400, errMissing); errWrite != nil {
+			s.writeError(w, r, 400, errWrite.Error())
+		}
+		return errMissing
+	}
+	// Validate the args.
+	if v, ok := args.Interface().(Validator); ok {
+		if errValid := v.Validate(); errValid != nil {
+			if errWrite := writeCodecError(w, codecReq, 400, errValid); errWrite != nil {
+				s.writeError(w, r, 400, errWrite.Error())
+			}
+			return errValid
+		}
+	}
+	if s.callInfo {
+		r = withCallInfo(r, &CallInfo{
+			Method:      method,
+			Service:     serviceSpec.name,
+			RemoteIP:    state.ip,
+			ContentType: contentType,
+			RequestID:   RequestID(r.Context()),
+		})
+	}
+	if len(s.before) > 0 {
+		info := state.info(r)
+		for _, f := range s.before {
+			if errBefore := f(info); errBefore != nil {
+				s.writeRequestError(w, r, codecReq, 403, errBefore.Error())
+				return errBefore
+			}
+		}
+	}
+	s.setResponseHeaders(w)
+	if methodSpec.streams {
+		return s.callStream(w, r, serviceSpec, methodSpec, codecReq, args)
+	}
+	if methodSpec.writes {
+		return s.callWriter(w, r, serviceSpec, methodSpec, args)
 	}
 	// Call the service method.
-	reply := reflect.New(methodSpec.replyType)
-	errValue := methodSpec.method.Func.Call([]reflect.Value{
-		serviceSpec.rcvr,
-		reflect.ValueOf(r),
-		args,
-		reply,
-	})
-	// Cast the result to error if needed.
-	var errResult error
-	errInter := errValue[0].Interface()
-	if errInter != nil {
-		errResult = errInter.(error)
+	var reply reflect.Value
+	if !methodSpec.returnsReply {
+		reply = reflect.New(methodSpec.replyType)
 	}
+	reply, errResult, ok := s.call(r, state, serviceSpec, methodSpec, args, reply)
+	if !ok {
+		// The method still runs, and may still change its args, which are
+		// not passed on to the functions and the logger reporting the call.
+		state.args = reflect.Value{}
+	}
+	if r.Context().Err() == context.Canceled {
+		// The client is gone: there is no one to respond to.
+		w.status = StatusClientClosedRequest
+		if s.canceled != nil {
+			s.canceled(state.info(r))
+		}
+		return context.Canceled
+	}
+	if !ok {
+		s.writeRequestError(w, r, codecReq, 504, ErrTimeout.Error())
+		return ErrTimeout
+	}
+	if rendered, ok := errResult.(*RenderedError); ok {
+		if errWrite := writeRendered(w, rendered); errWrite != nil {
+			return errWrite
+		}
+		return errResult
+	}
+	if errResult == ErrAccepted {
+		// The work started by the method completes later: its reply, e.g.
+		// a tracking token, is sent as a successful response.
+		w.status = 202
+		errResult = nil
+	} else if errResult == nil {
+		if sc, ok := reply.Interface().(StatusCoder); ok {
+			w.status = sc.StatusCode()
+		}
+	} else if hs, ok := errResult.(HTTPStatuser); ok {
+		w.status = hs.HTTPStatus()
+	}
+	// Encode the response. The method was called successfully, so failing
+	// to encode its reply is a server error, which can only be reported if
+	// the codec did not start writing the response.
+	if errWrite := s.writeReply(w, r, codecReq, reply.Interface(), errResult); errWrite != nil {
+		if !w.wroteHeader {
+			s.writeError(w, r, 500, errWrite.Error())
+		}
+		return errWrite
+	}
+	return errResult
+}
+
+// SetResponseHeaders sets headers added to the responses of every method
+// called, e.g. security headers such as X-Frame-Options. They are added to
+// the X-Content-Type-Options nosniff header sent by default, which they
+// replace if they set it. A header with no values is removed instead.
+func (s *Server) SetResponseHeaders(header http.Header) {
+	s.headers = make(http.Header, len(header))
+	for key, values := range header {
+		s.headers[http.CanonicalHeaderKey(key)] = append([]string(nil), values...)
+	}
+}
+
+// setResponseHeaders adds the default and configured headers to the
+// response of a method call.
+func (s *Server) setResponseHeaders(w http.ResponseWriter) {
+	h := w.Header()
 	// Prevents Internet Explorer from MIME-sniffing a response away
 	// from the declared content-type
-	w.Header().Set("x-content-type-options", "nosniff")
-	// Encode the response.
-	if errWrite := codecReq.WriteResponse(w, reply.Interface(), errResult); errWrite != nil {
-		writeError(w, 400, errWrite.Error())
+	h.Set("X-Content-Type-Options", "nosniff")
+	for key, values := range s.headers {
+		if len(values) == 0 {
+			h.Del(key)
+		} else {
+			h[key] = append([]string(nil), values...)
+		}
+	}
+}
+
+// allowedMethods returns the HTTP methods accepted by the server.
+func (s *Server) allowedMethods() []string {
+	return []string{"POST", "OPTIONS"}
+}
+
+// writeOptions responds to an OPTIONS request with the accepted HTTP
+// methods, in the Allow header, and the content types of the registered
+// codecs, one per line.
+func (s *Server) writeOptions(w http.ResponseWriter) {
+	types := make([]string, 0, len(s.codecs))
+	for contentType := range s.codecs {
+		types = append(types, contentType)
+	}
+	sort.Strings(types)
+	w.Header().Set("Allow", strings.Join(s.allowedMethods(), ", "))
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(200)
+	for _, contentType := range types {
+		fmt.Fprintln(w, contentType)
 	}
 }
 
-func (s *Server) clientAllowed(remoteAddr string) (err error) {
+// call invokes the method. If the request declares a valid TimeoutHeader,
+// the method receives a request whose context expires after that duration
+// and ok is false if the method does not complete in time.
+//
+// The state of the request, if not nil, holds the resources it uses until
+// the method returns, even if it does not complete in time.
+func (s *Server) call(r *http.Request, state *requestState, service *service, method *serviceMethod, args, reply reflect.Value) (_ reflect.Value, err error, ok bool) {
+	timeout := s.requestTimeout(r)
+	if timeout == 0 {
+		reply, err = method.call(service.rcvr, reflect.ValueOf(r), args, reply)
+		return reply, err, true
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+	if method.streams || method.writes {
+		// Streaming methods write the response themselves, so they run
+		// synchronously and are expected to honor the context deadline.
+		reply, err = method.call(service.rcvr, reflect.ValueOf(r.WithContext(ctx)), args, reply)
+		return reply, err, true
+	}
+	type result struct {
+		reply reflect.Value
+		err   error
+	}
+	done := make(chan result, 1)
+	returned := func() {}
+	if state != nil {
+		returned = state.callStarted()
+	}
+	go func() {
+		defer returned()
+		reply, err := method.call(service.rcvr, reflect.ValueOf(r.WithContext(ctx)), args, reply)
+		done <- result{reply, err}
+	}()
+	select {
+	case res := <-done:
+		return res.reply, res.err, true
+	case <-ctx.Done():
+		return reflect.Value{}, nil, false
+	}
+}
+
+// requestTimeout returns the duration declared in the TimeoutHeader, capped
+// by the server maximum, or zero if the header is absent or invalid.
+func (s *Server) requestTimeout(r *http.Request) time.Duration {
+	header := r.Header.Get(TimeoutHeader)
+	if header == "" {
+		return 0
+	}
+	timeout, err := time.ParseDuration(header)
+	if err != nil || timeout <= 0 {
+		return 0
+	}
+	if s.timeout > 0 && timeout > s.timeout {
+		timeout = s.timeout
+	}
+	return timeout
+}
+
+// clientAllowed checks the client IP, or the error reading it, against the
+// filters set with Bind, if any.
+func (s *Server) clientAllowed(ip net.IP, errIP error) error {
 	if len(s.filters) == 0 {
 		return nil
 	}
-	var (
-		host string
-		ip   net.IP
-	)
-	if host, _, err = net.SplitHostPort(remoteAddr); err != nil {
-		return fmt.Errorf("%s: %s", ErrMalformedRemoteIp, err)
-	}
-	if ip = net.ParseIP(host); ip == nil {
-		return ErrMalformedRemoteIp
+	if errIP != nil {
+		return errIP
 	}
 	for _, whitelisted := range s.filters {
 		if whitelisted(ip) {
@@ -222,8 +1241,330 @@ func (s *Server) clientAllowed(remoteAddr string) (err error) {
 	return ErrRemoteNotAllowed
 }
 
-func writeError(w http.ResponseWriter, status int, msg string) {
+// certAllowed checks the TLS connection state of the request with the
+// verifier set with SetClientCertVerifier, if any.
+func (s *Server) certAllowed(r *http.Request) error {
+	if s.certs == nil {
+		return nil
+	}
+	if r.TLS == nil {
+		return ErrTLSRequired
+	}
+	return s.certs(r.TLS)
+}
+
+// methodAllowed checks the client against the networks the method is
+// restricted to, if any.
+func (s *Server) methodAllowed(method string, ip net.IP, errIP error) error {
+	nets, ok := s.acl[strings.ToLower(method)]
+	if !ok {
+		return nil
+	}
+	if errIP != nil {
+		return errIP
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return nil
+		}
+	}
+	return ErrRemoteNotAllowed
+}
+
+// responseWriter wraps an http.ResponseWriter recording the response status.
+type responseWriter struct {
+	http.ResponseWriter
+	status      int   // status sent, or to be sent with the first write
+	wroteHeader bool  // whether the header was sent
+	written     int64 // number of body bytes written
+}
+
+// WriteHeader records the status and sends the response header.
+func (w *responseWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status = status
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Write sends the response body, implicitly writing the header if it was
+// not written yet.
+func (w *responseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(w.Status())
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.written += int64(n)
+	return n, err
+}
+
+// Flush sends any buffered data to the client, if supported by the
+// underlying http.ResponseWriter.
+func (w *responseWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(w.Status())
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Status returns the response status, which is 200 unless set otherwise.
+func (w *responseWriter) Status() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+// countingReader counts the bytes read from a request body.
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+// Read reads from the body, counting the bytes read.
+func (r *countingReader) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	r.n += int64(n)
+	return n, err
+}
+
+// timeoutReader fails reads of a request body past a deadline.
+type timeoutReader struct {
+	io.ReadCloser
+	deadline time.Time
+	timedOut bool
+}
+
+// Read reads from the body, returning ErrReadTimeout if no data is read
+// before the deadline. Reads are not possible once the deadline expired, as
+// the pending read may still complete in the background.
+func (r *timeoutReader) Read(b []byte) (int, error) {
+	if r.timedOut {
+		return 0, ErrReadTimeout
+	}
+	timer := time.NewTimer(time.Until(r.deadline))
+	defer timer.Stop()
+	type result struct {
+		n   int
+		err error
+	}
+	buf := make([]byte, len(b))
+	done := make(chan result, 1)
+	go func() {
+		n, err := r.ReadCloser.Read(buf)
+		done <- result{n, err}
+	}()
+	select {
+	case res := <-done:
+		return copy(b, buf[:res.n]), res.err
+	case <-timer.C:
+		r.timedOut = true
+		return 0, ErrReadTimeout
+	}
+}
+
+// limitReader fails reads of a request body past a number of bytes.
+type limitReader struct {
+	io.ReadCloser
+	n        int64 // bytes left to read
+	exceeded bool
+}
+
+// Read reads from the body, returning ErrBodyTooLarge once more than the
+// limit was sent.
+func (r *limitReader) Read(b []byte) (int, error) {
+	if r.exceeded {
+		return 0, ErrBodyTooLarge
+	}
+	if int64(len(b)) > r.n+1 {
+		// Read one byte past the limit to detect larger bodies.
+		b = b[:r.n+1]
+	}
+	n, err := r.ReadCloser.Read(b)
+	if int64(n) > r.n {
+		r.exceeded = true
+		return int(r.n), ErrBodyTooLarge
+	}
+	r.n -= int64(n)
+	return n, err
+}
+
+// responseCodecRequest returns a CodecRequest writing responses with a codec
+// which did not decode the request.
+func responseCodecRequest(codec Codec, r *http.Request) CodecRequest {
+	if encoder, ok := codec.(ResponseEncoder); ok {
+		return encoderRequest{encoder}
+	}
+	return codec.NewRequest(r)
+}
+
+// encoderRequest is the CodecRequest of a ResponseEncoder, only used to
+// write responses.
+type encoderRequest struct {
+	encoder ResponseEncoder
+}
+
+func (c encoderRequest) Method() (string, error) {
+	return "", errors.New("rpc: request already read")
+}
+
+func (c encoderRequest) ReadRequest(interface{}) error {
+	return errors.New("rpc: request already read")
+}
+
+func (c encoderRequest) WriteResponse(w http.ResponseWriter, reply interface{}, methodErr error) error {
+	return c.encoder.EncodeResponse(w, reply, methodErr)
+}
+
+// writeCodecError encodes an error using the codec and responds with the
+// given status.
+func writeCodecError(w *responseWriter, codecReq CodecRequest, status int, err error) error {
+	w.status = status
+	return codecReq.WriteResponse(w, nil, err)
+}
+
+// mediaType returns the media type of a content type, lower cased and
+// stripped of its parameters and surrounding white space.
+func mediaType(contentType string) string {
+	if idx := strings.Index(contentType, ";"); idx != -1 {
+		contentType = contentType[:idx]
+	}
+	return strings.ToLower(strings.TrimSpace(contentType))
+}
+
+// remoteIP returns the IP of a remote address in "host:port" form. The zone
+// of IPv6 link-local addresses, as in "[fe80::1%eth0]:80", is ignored.
+func remoteIP(remoteAddr string) (net.IP, error) {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", ErrMalformedRemoteIp, err)
+	}
+	if idx := strings.Index(host, "%"); idx != -1 {
+		host = host[:idx]
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, ErrMalformedRemoteIp
+	}
+	return ip, nil
+}
+
+// clientIP returns the IP of the client of a request, read from its
+// X-Forwarded-For header when the request comes from a trusted proxy.
+func (s *Server) clientIP(r *http.Request) (net.IP, error) {
+	ip, err := remoteIP(r.RemoteAddr)
+	if err != nil || len(s.proxies) == 0 {
+		return ip, err
+	}
+	var hops []string
+	for _, header := range r.Header["X-Forwarded-For"] {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	// Walk back the proxies, from the one closest to the server, up to the
+	// first address not trusted.
+	for i := len(hops) - 1; i >= 0 && s.trusted(ip); i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+	}
+	return ip, nil
+}
+
+// trusted returns true if the IP is within the networks of trusted proxies.
+func (s *Server) trusted(ip net.IP) bool {
+	for _, n := range s.proxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// TransportErrorFormat selects how the server writes errors for requests it
+// rejects itself, before or outside of a codec.
+type TransportErrorFormat int
+
+const (
+	// TransportErrorText writes the error message as plain text, unless
+	// the codec the request is meant for is an ErrorWriter.
+	TransportErrorText TransportErrorFormat = iota
+	// TransportErrorJSON writes a JSON object holding the HTTP status code
+	// and the error message:
+	//
+	//	{"error": {"code": 415, "message": "rpc: unrecognized Content-Type: text/xml"}}
+	TransportErrorJSON
+)
+
+// transportError is the body of an error written in TransportErrorJSON
+// format.
+type transportError struct {
+	Error struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// SetTransportErrorFormat sets the format of the errors written by the server
+// for rejected requests, e.g. an unrecognized Content-Type or a client not
+// allowed by Bind. Errors resulting from method calls are still written by
+// the codec. The default format is TransportErrorText.
+func (s *Server) SetTransportErrorFormat(format TransportErrorFormat) {
+	s.errors = format
+}
+
+// writeError writes an error in the transport error format of the server.
+// Errors in the default format are encoded by the codec the request is meant
+// for, if it is an ErrorWriter, and written as plain text otherwise.
+func (s *Server) writeError(w http.ResponseWriter, r *http.Request, status int, msg string) {
+	if s.errors != TransportErrorJSON {
+		if ew, ok := s.codecFor(r).(ErrorWriter); ok {
+			ew.WriteError(w, status, errors.New(msg))
+		} else {
+			writeError(w, status, msg)
+		}
+		return
+	}
+	var body transportError
+	body.Error.Code = status
+	body.Error.Message = msg
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&body)
+}
+
+// writeRequestError writes an error response to a request read by the codec
+// request, through the codec request itself if it is an ErrorWriter, e.g. to
+// echo the request id.
+func (s *Server) writeRequestError(w http.ResponseWriter, r *http.Request, codecReq CodecRequest, status int, msg string) {
+	if ew, ok := codecReq.(ErrorWriter); ok && s.errors != TransportErrorJSON {
+		ew.WriteError(w, status, errors.New(msg))
+		return
+	}
+	s.writeError(w, r, status, msg)
+}
+
+// codecFor returns the codec registered for the request Content-Type or, if
+// there is none, for the first acceptable media type, e.g. to encode errors
+// for requests with a wrong HTTP method.
+func (s *Server) codecFor(r *http.Request) Codec {
+	if codec := s.codecs[s.requestContentType(r)]; codec != nil {
+		return codec
+	}
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		if codec := s.codecs[mediaType(accept)]; codec != nil {
+			return codec
+		}
+	}
+	return nil
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
 	fmt.Fprint(w, msg)
 }
@@ -7,11 +7,26 @@
 package rpc
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 type Service1Request struct {
@@ -31,9 +46,275 @@ func (t *Service1) Multiply(r *http.Request, req *Service1Request, res *Service1
 	return nil
 }
 
+func (t *Service1) Add(r *http.Request, req *Service1Request) (Service1Response, error) {
+	return Service1Response{req.A + req.B}, nil
+}
+
+func (t *Service1) Subtract(r *http.Request, req *Service1Request, res *Service1Response) error {
+	res.Result = req.A - req.B
+	return nil
+}
+
+func (t *Service1) Difference(r *http.Request, req *Service1Request) (*Service1Response, error) {
+	return &Service1Response{req.A - req.B}, nil
+}
+
+type SleepRequest struct {
+	Duration time.Duration
+}
+
+type SleepResponse struct {
+	Deadline bool
+}
+
+func (t *Service1) Sleep(r *http.Request, req *SleepRequest, res *SleepResponse) error {
+	_, res.Deadline = r.Context().Deadline()
+	select {
+	case <-time.After(req.Duration):
+	case <-r.Context().Done():
+	}
+	return nil
+}
+
 type Service2 struct {
 }
 
+// testCodec is a minimal JSON codec used to exercise the server without
+// depending on any of the codec packages.
+type testCodec struct {
+}
+
+func (c *testCodec) NewRequest(r *http.Request) CodecRequest {
+	req := new(testCodecRequest)
+	req.err = json.NewDecoder(r.Body).Decode(&req.request)
+	return req
+}
+
+type testRequest struct {
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+}
+
+type testResponse struct {
+	Result json.RawMessage `json:"result"`
+	Error  interface{}     `json:"error"`
+}
+
+type testCodecRequest struct {
+	request testRequest
+	err     error
+}
+
+func (c *testCodecRequest) Method() (string, error) {
+	return c.request.Method, c.err
+}
+
+func (c *testCodecRequest) ReadRequest(args interface{}) error {
+	if c.err != nil {
+		return c.err
+	}
+	return json.Unmarshal(c.request.Params, args)
+}
+
+func (c *testCodecRequest) WriteResponse(w http.ResponseWriter, reply interface{}, methodErr error) error {
+	res := map[string]interface{}{"result": reply, "error": nil}
+	if methodErr != nil {
+		res["result"] = nil
+		res["error"] = methodErr.Error()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(res)
+}
+
+// headerCodec reads the method from a header and the args from the whole
+// request body, as binary codecs may do.
+type headerCodec struct {
+}
+
+func (c *headerCodec) NewRequest(r *http.Request) CodecRequest {
+	return &headerCodecRequest{r: r}
+}
+
+type headerCodecRequest struct {
+	testCodecRequest
+	r *http.Request
+}
+
+func (c *headerCodecRequest) Method() (string, error) {
+	if method := c.r.Header.Get("X-RPC-Method"); method != "" {
+		return method, nil
+	}
+	return "", errors.New("header: missing X-RPC-Method")
+}
+
+func (c *headerCodecRequest) ReadRequest(args interface{}) error {
+	return json.NewDecoder(c.r.Body).Decode(args)
+}
+
+// xmlCodec encodes responses as XML, ignoring the request.
+type xmlCodec struct {
+}
+
+func (c *xmlCodec) NewRequest(r *http.Request) CodecRequest {
+	return new(xmlCodecRequest)
+}
+
+type xmlCodecRequest struct {
+}
+
+func (c *xmlCodecRequest) Method() (string, error) {
+	return "", errors.New("xml: requests not supported")
+}
+
+func (c *xmlCodecRequest) ReadRequest(args interface{}) error {
+	return errors.New("xml: requests not supported")
+}
+
+func (c *xmlCodecRequest) WriteResponse(w http.ResponseWriter, reply interface{}, methodErr error) error {
+	w.Header().Set("Content-Type", "text/xml")
+	return xml.NewEncoder(w).Encode(reply)
+}
+
+// xmlEncoder is an xmlCodec encoding responses to requests decoded by
+// other codecs.
+type xmlEncoder struct {
+	xmlCodec
+}
+
+func (c *xmlEncoder) EncodeResponse(w http.ResponseWriter, reply interface{}, methodErr error) error {
+	return new(xmlCodecRequest).WriteResponse(w, reply, methodErr)
+}
+
+func newTestServer(t *testing.T) *Server {
+	s := NewServer()
+	s.RegisterCodec(new(testCodec), "application/json")
+	if err := s.RegisterService(new(Service1), ""); err != nil {
+		t.Fatal("expected err to be nil, got instead:", err)
+	}
+	return s
+}
+
+func newTestRequest(method string, params interface{}) *http.Request {
+	buf, _ := json.Marshal(map[string]interface{}{"method": method, "params": params})
+	r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewReader(buf))
+	r.Header.Set("Content-Type", "application/json")
+	r.RemoteAddr = "127.0.0.1:8080"
+	return r
+}
+
+func serveTest(s *Server, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+func TestHasCodec(t *testing.T) {
+	s := NewServer()
+	s.RegisterCodec(new(testCodec), "application/json")
+	if !s.HasCodec("application/json; charset=utf-8") {
+		t.Error("expected a codec for application/json; charset=utf-8")
+	}
+	if !s.HasCodec("Application/JSON") {
+		t.Error("expected a codec for Application/JSON")
+	}
+	if s.HasCodec("text/xml") {
+		t.Error("expected no codec for text/xml")
+	}
+}
+
+func TestHeaderMethodCodec(t *testing.T) {
+	s := newTestServer(t)
+	s.RegisterCodec(new(headerCodec), "application/x-args")
+	body, _ := json.Marshal(&Service1Request{4, 2})
+	r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewReader(body))
+	r.Header.Set("Content-Type", "application/x-args")
+	r.Header.Set("X-RPC-Method", "Service1.Multiply")
+	r.RemoteAddr = "127.0.0.1:8080"
+	if w := serveTest(s, r); w.Code != 200 || !strings.Contains(w.Body.String(), `"Result":8`) {
+		t.Errorf("expected the method read from the header to be called, got instead: %d %s", w.Code, w.Body.String())
+	}
+	r, _ = http.NewRequest("POST", "http://localhost:8080/", bytes.NewReader(body))
+	r.Header.Set("Content-Type", "application/x-args")
+	r.RemoteAddr = "127.0.0.1:8080"
+	if w := serveTest(s, r); w.Code != 400 {
+		t.Errorf("expected w.Code to be 400 without the header, got instead: %d", w.Code)
+	}
+}
+
+func TestNoCodecs(t *testing.T) {
+	s := NewServer()
+	s.RegisterService(new(Service1), "")
+	w := serveTest(s, newTestRequest("Service1.Multiply", &Service1Request{4, 2}))
+	if w.Code != 500 || !strings.Contains(w.Body.String(), ErrNoCodecs.Error()) {
+		t.Errorf("expected 500 and %q, got instead: %d %q", ErrNoCodecs, w.Code, w.Body.String())
+	}
+	func() {
+		defer func() {
+			if err := recover(); err != ErrNoCodecs {
+				t.Errorf("expected MustHaveCodec to panic with %q, got instead: %v", ErrNoCodecs, err)
+			}
+		}()
+		s.MustHaveCodec()
+	}()
+	s.RegisterCodec(new(testCodec), "application/json")
+	s.MustHaveCodec()
+}
+
+func TestDefaultCodec(t *testing.T) {
+	s := newTestServer(t)
+	send := func(contentType string) *httptest.ResponseRecorder {
+		r := newTestRequest("Service1.Multiply", &Service1Request{4, 2})
+		if contentType == "" {
+			r.Header.Del("Content-Type")
+		} else {
+			r.Header.Set("Content-Type", contentType)
+		}
+		return serveTest(s, r)
+	}
+	if w := send(""); w.Code != 415 {
+		t.Errorf("expected w.Code to be 415 without a default codec, got instead: %d", w.Code)
+	}
+	s.SetDefaultCodec("application/json")
+	if w := send(""); w.Code != 200 || !strings.Contains(w.Body.String(), `"Result":8`) {
+		t.Errorf("expected the default codec to be used, got instead: %d %s", w.Code, w.Body.String())
+	}
+	if w := send("application/x-unknown"); w.Code != 415 {
+		t.Errorf("expected w.Code to be 415 for an unknown Content-Type, got instead: %d", w.Code)
+	}
+}
+
+func TestCodecMaxBytes(t *testing.T) {
+	s := newTestServer(t)
+	s.RegisterCodec(new(testCodec), "application/msgpack")
+	s.SetCodecMaxBytes("application/json", 100)
+	s.SetCodecMaxBytes("application/msgpack", 1000)
+	send := func(contentType string, size int, chunked bool) int {
+		r := newTestRequest("Service1.Multiply", map[string]interface{}{"A": 4, "B": 2, "Pad": strings.Repeat("x", size)})
+		r.Header.Set("Content-Type", contentType)
+		if chunked {
+			r.ContentLength = -1
+		}
+		return serveTest(s, r).Code
+	}
+	table := []struct {
+		contentType string
+		size        int
+		status      int
+	}{
+		{"application/json", 10, 200},
+		{"application/json", 200, 413},
+		{"application/msgpack", 200, 200},
+		{"application/msgpack", 2000, 413},
+	}
+	for _, rec := range table {
+		for _, chunked := range []bool{false, true} {
+			if status := send(rec.contentType, rec.size, chunked); status != rec.status {
+				t.Errorf("%s of %d bytes (chunked %v): expected status %d, got instead: %d", rec.contentType, rec.size, chunked, rec.status, status)
+			}
+		}
+	}
+}
+
 func TestRegisterService(t *testing.T) {
 	var err error
 	s := NewServer()
@@ -54,6 +335,8 @@ func TestRegisterService(t *testing.T) {
 	err = s.RegisterService(service2, "")
 	if err == nil {
 		t.Errorf("Expected error on service2")
+	} else if msg := err.Error(); !strings.Contains(msg, "*github.com/x-formation/rpc.Service2") || !strings.Contains(msg, "0 examined") {
+		t.Errorf("Expected error to name the Service2 type, got instead: %q", msg)
 	}
 }
 
@@ -83,6 +366,131 @@ func executeTable(t *testing.T, srv *Server, table []record) {
 	}
 }
 
+type NearMissService struct{}
+
+func (t *NearMissService) Multiply(r *http.Request, req *Service1Request, res *Service1Response) error {
+	return nil
+}
+
+func (t *NearMissService) Add(r *http.Request, req Service1Request, res *Service1Response) error {
+	return nil
+}
+
+func (t *NearMissService) Helper(n int) int {
+	return n
+}
+
+func TestRegisterNearMiss(t *testing.T) {
+	s := NewServer()
+	err := s.RegisterService(new(NearMissService), "")
+	if err == nil {
+		t.Fatal("expected err for a method with a non pointer args")
+	}
+	if msg := err.Error(); !strings.Contains(msg, "Add") || !strings.Contains(msg, "args") || !strings.Contains(msg, "rpc.Service1Request") {
+		t.Errorf("expected err to name the method and its args, got instead: %q", msg)
+	}
+	if s.HasMethod("NearMissService.Multiply") {
+		t.Error("expected service not to be registered")
+	}
+}
+
+type HelperService struct{}
+
+func (t *HelperService) Multiply(r *http.Request, req *Service1Request, res *Service1Response) error {
+	res.Result = req.A * req.B
+	return nil
+}
+
+func (t *HelperService) ServeHTTP(w http.ResponseWriter, r *http.Request) {}
+
+func (t *HelperService) Token(r *http.Request) string {
+	return r.Header.Get("X-Token")
+}
+
+func (t *HelperService) Lookup(r *http.Request, key string) (string, bool) {
+	return key, true
+}
+
+func TestRegisterHelpers(t *testing.T) {
+	s := NewServer()
+	if err := s.RegisterService(new(HelperService), ""); err != nil {
+		t.Fatal("expected methods which are not near misses to be ignored, got instead:", err)
+	}
+	if !s.HasMethod("HelperService.Multiply") {
+		t.Error("expected HelperService.Multiply to be registered")
+	}
+	for _, method := range []string{"HelperService.ServeHTTP", "HelperService.Token", "HelperService.Lookup"} {
+		if s.HasMethod(method) {
+			t.Errorf("expected %s to be ignored", method)
+		}
+	}
+}
+
+func TestNameInferrer(t *testing.T) {
+	s := newTestServer(t)
+	s.SetNameInferrer(func(t reflect.Type) string {
+		return strings.ToLower(t.Name())
+	})
+	if err := s.RegisterService(new(Service3), ""); err != nil {
+		t.Fatal("expected err to be nil, got instead:", err)
+	}
+	if !s.HasMethod("service3.Multiply") || s.HasMethod("Service3.Multiply") {
+		t.Error("expected Service3 to be registered as service3")
+	}
+	if err := s.RegisterService(new(Service3), "Named"); err != nil || !s.HasMethod("Named.Multiply") {
+		t.Errorf("expected given names to be used, got instead: %v", err)
+	}
+	s.SetNameInferrer(func(reflect.Type) string { return "" })
+	if err := s.RegisterService(new(Service3), ""); err == nil {
+		t.Error("expected err when no name is inferred")
+	}
+}
+
+func TestRegisterServiceAliases(t *testing.T) {
+	s := NewServer()
+	if err := s.RegisterServiceAliases(new(Service1), "Foo", "Bar"); err != nil {
+		t.Fatal("expected err to be nil, got instead:", err)
+	}
+	for _, method := range []string{"Foo.Multiply", "Bar.Multiply"} {
+		if !s.HasMethod(method) {
+			t.Errorf("expected %s to be registered", method)
+		}
+	}
+	if err := s.RegisterServiceAliases(new(Service1), "Baz", "Foo"); err == nil {
+		t.Error("expected err when an alias is already registered")
+	}
+	if s.HasMethod("Baz.Multiply") {
+		t.Error("expected Baz to be rolled back")
+	}
+	if err := s.RegisterServiceAliases(new(Service1)); err == nil {
+		t.Error("expected err when no name is given")
+	}
+
+	inferred := NewServer()
+	if err := inferred.RegisterServiceAliases(new(Service1), "", "Foo"); err != nil {
+		t.Fatal("expected err to be nil with an inferred first name, got instead:", err)
+	}
+	for _, method := range []string{"Service1.Multiply", "Foo.Multiply"} {
+		if !inferred.HasMethod(method) {
+			t.Errorf("expected %s to be registered", method)
+		}
+	}
+	if err := inferred.RegisterServiceAliases(new(Service1), "Baz", ""); err == nil {
+		t.Error("expected err for an empty alias")
+	}
+	if inferred.HasMethod("Baz.Multiply") {
+		t.Error("expected Baz to be rolled back")
+	}
+
+	s.SetNameInferrer(func(reflect.Type) string { return "service1" })
+	if err := s.RegisterServiceAliases(new(Service1), "", "Foo"); err == nil {
+		t.Error("expected err when an alias of an inferred name is already registered")
+	}
+	if s.HasMethod("service1.Multiply") {
+		t.Error("expected the inferred name to be rolled back")
+	}
+}
+
 func TestBind(t *testing.T) {
 	srv := NewServer()
 	srv.Bind(
@@ -100,6 +508,55 @@ func TestBind(t *testing.T) {
 	executeTable(t, srv, table)
 }
 
+func TestBindFunc(t *testing.T) {
+	srv := NewServer()
+	srv.BindFunc(func(ip net.IP) bool {
+		ip = ip.To4()
+		return ip != nil && ip[3]%2 == 0
+	})
+	executeTable(t, srv, []record{
+		{"10.0.0.2:8080", true},
+		{"10.0.0.3:8080", false},
+		{"192.168.1.100:8081", true},
+		{"192.168.1.101:8081", false},
+		{"[::1]:8082", false},
+	})
+	srv.Bind(net.IPv4(10, 0, 0, 3))
+	executeTable(t, srv, []record{
+		{"10.0.0.3:8080", true},
+		{"10.0.0.5:8080", false},
+	})
+}
+
+func TestRestrictMethod(t *testing.T) {
+	s := newTestServer(t)
+	_, admin, _ := net.ParseCIDR("10.1.0.0/16")
+	s.RestrictMethod("Service1.Add", admin)
+	table := []struct {
+		method string
+		addr   string
+		status int
+	}{
+		{"Service1.Multiply", "192.168.0.1:8080", 200},
+		{"Service1.Add", "192.168.0.1:8080", 403},
+		{"Service1.Add", "10.1.2.3:8080", 200},
+		{"Service1.Multiply", "10.1.2.3:8080", 200},
+	}
+	for _, rec := range table {
+		r := newTestRequest(rec.method, &Service1Request{4, 2})
+		r.RemoteAddr = rec.addr
+		if w := serveTest(s, r); w.Code != rec.status {
+			t.Errorf("%s from %s: expected status %d, got instead: %d", rec.method, rec.addr, rec.status, w.Code)
+		}
+	}
+	s.SetCaseInsensitiveMethods(true)
+	r := newTestRequest("service1.add", &Service1Request{4, 2})
+	r.RemoteAddr = "192.168.0.1:8080"
+	if w := serveTest(s, r); w.Code != 403 {
+		t.Errorf("expected status 403, got instead: %d", w.Code)
+	}
+}
+
 func TestBindLocal(t *testing.T) {
 	srv := NewServer()
 	before := []record{
@@ -118,3 +575,1931 @@ func TestBindLocal(t *testing.T) {
 	}
 	executeTable(t, srv, after)
 }
+
+func TestBindZonedIPv6(t *testing.T) {
+	srv := NewServer()
+	srv.Bind(net.ParseIP("fe80::1"))
+	executeTable(t, srv, []record{
+		{"[fe80::1%eth0]:8080", true},
+		{"[fe80::1]:8080", true},
+		{"[fe80::2%eth0]:8080", false},
+	})
+	if err := srv.clientAllowed(remoteIP("[fe80::1%eth0]:8080")); err != nil {
+		t.Error("expected err to be nil, got instead:", err)
+	}
+}
+
+func TestBindLocalLoopback(t *testing.T) {
+	defer func(f func() ([]net.Addr, error)) { interfaceAddrs = f }(interfaceAddrs)
+	interfaceAddrs = func() ([]net.Addr, error) { return nil, nil }
+	srv := NewServer()
+	if err := srv.BindLocal(); err != nil {
+		t.Fatal("expected err to be nil, got instead:", err)
+	}
+	executeTable(t, srv, []record{
+		{"127.0.0.1:8083", true},
+		{"[::1]:8084", true},
+		{"32.32.33.33:8081", false},
+	})
+}
+
+func TestBindPrivate(t *testing.T) {
+	defer func(f func() ([]net.Addr, error)) { interfaceAddrs = f }(interfaceAddrs)
+	interfaceAddrs = func() ([]net.Addr, error) { return nil, nil }
+	srv := NewServer()
+	if err := srv.BindLocal(); err != nil {
+		t.Fatal("expected err to be nil, got instead:", err)
+	}
+	executeTable(t, srv, []record{
+		{"172.17.0.5:8080", false},
+	})
+	srv = NewServer()
+	srv.BindPrivate()
+	executeTable(t, srv, []record{
+		{"172.17.0.5:8080", true},
+		{"10.1.2.3:8080", true},
+		{"192.168.1.100:8081", true},
+		{"127.0.0.1:8083", true},
+		{"[::1]:8084", true},
+		{"[fd00::1]:8084", true},
+		{"172.32.0.1:8080", false},
+		{"32.32.33.33:8081", false},
+	})
+}
+
+type observation struct {
+	method  string
+	status  int
+	latency time.Duration
+	err     error
+}
+
+func TestMetricsObserver(t *testing.T) {
+	var got []observation
+	s := newTestServer(t)
+	s.SetMetricsObserver(func(method string, status int, latency time.Duration, err error) {
+		got = append(got, observation{method, status, latency, err})
+	})
+	serveTest(s, newTestRequest("Service1.Multiply", &Service1Request{4, 2}))
+	serveTest(s, newTestRequest("Service1.Multiply", "bad params"))
+	if len(got) != 2 {
+		t.Fatalf("expected 2 observations, got instead: %d", len(got))
+	}
+	table := []struct {
+		status int
+		failed bool
+	}{
+		{200, false},
+		{400, true},
+	}
+	for i, exp := range table {
+		if got[i].method != "Service1.Multiply" {
+			t.Errorf("expected method to be Service1.Multiply, got instead: %q", got[i].method)
+		}
+		if got[i].status != exp.status {
+			t.Errorf("expected status to be %d, got instead: %d", exp.status, got[i].status)
+		}
+		if got[i].latency <= 0 {
+			t.Errorf("expected latency to be positive, got instead: %v", got[i].latency)
+		}
+		if (got[i].err != nil) != exp.failed {
+			t.Errorf("expected err to be reported: %v, got instead: %v", exp.failed, got[i].err)
+		}
+	}
+}
+
+func TestSizeObserver(t *testing.T) {
+	var method string
+	var read, written int64
+	s := newTestServer(t)
+	s.SetSizeObserver(func(m string, r, w int64) {
+		method, read, written = m, r, w
+	})
+	r := newTestRequest("Service1.Multiply", &Service1Request{4, 2})
+	size := r.ContentLength
+	w := serveTest(s, r)
+	if method != "Service1.Multiply" {
+		t.Errorf("expected method to be Service1.Multiply, got instead: %q", method)
+	}
+	if read != size {
+		t.Errorf("expected %d bytes read, got instead: %d", size, read)
+	}
+	if written != int64(w.Body.Len()) {
+		t.Errorf("expected %d bytes written, got instead: %d", w.Body.Len(), written)
+	}
+	if written == 0 {
+		t.Error("expected response body to be written")
+	}
+}
+
+func TestMethodNotFound(t *testing.T) {
+	s := newTestServer(t)
+	table := []struct {
+		method string
+		params interface{}
+		code   int
+	}{
+		{"Service1.Multiply", &Service1Request{4, 2}, 200},
+		{"Service1.Divide", &Service1Request{4, 2}, 404},
+		{"Service3.Multiply", &Service1Request{4, 2}, 404},
+		{"Service1", &Service1Request{4, 2}, 400},
+		{"Service1.Multiply", "bad params", 400},
+	}
+	for _, exp := range table {
+		if w := serveTest(s, newTestRequest(exp.method, exp.params)); w.Code != exp.code {
+			t.Errorf("expected w.Code to be %d for %s, got instead: %d", exp.code, exp.method, w.Code)
+		}
+	}
+}
+
+func TestHealthHandler(t *testing.T) {
+	s := NewServer()
+	h := s.HealthHandler()
+	s.Bind(net.IPv4(233, 100, 100, 33))
+	r, _ := http.NewRequest("GET", "http://localhost:8080/health", nil)
+	r.RemoteAddr = "127.0.0.1:8080"
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != 503 {
+		t.Errorf("expected w.Code to be 503 without services, got instead: %d", w.Code)
+	}
+	s.RegisterCodec(new(testCodec), "application/json")
+	s.RegisterService(new(Service1), "")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != 200 || w.Body.String() != "healthy" {
+		t.Errorf("expected healthy 200 response, got instead: %d %q", w.Code, w.Body.String())
+	}
+	// Regular RPC requests are still subject to the server checks.
+	if w := serveTest(s, newTestRequest("Service1.Multiply", &Service1Request{4, 2})); w.Code != 403 {
+		t.Errorf("expected w.Code to be 403, got instead: %d", w.Code)
+	}
+	s = newTestServer(t)
+	s.HealthHandler()
+	if w := serveTest(s, newTestRequest("Service1.Multiply", &Service1Request{4, 2})); w.Code != 200 {
+		t.Errorf("expected w.Code to be 200, got instead: %d", w.Code)
+	}
+}
+
+func TestListMethods(t *testing.T) {
+	s := newTestServer(t)
+	if !s.HasMethod("rpc.listMethods") {
+		t.Fatal("expected to be registered: rpc.listMethods")
+	}
+	w := serveTest(s, newTestRequest("rpc.listMethods", &ListMethodsArgs{}))
+	var res testResponse
+	if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+		t.Fatal("expected err to be nil, got instead:", err)
+	}
+	var reply ListMethodsReply
+	if err := json.Unmarshal(res.Result, &reply); err != nil {
+		t.Fatal("expected err to be nil, got instead:", err)
+	}
+	for _, m := range reply.Methods {
+		if m.Name != "Service1.Multiply" {
+			continue
+		}
+		var args map[string]interface{}
+		if err := json.Unmarshal(m.Args, &args); err != nil {
+			t.Fatal("expected err to be nil, got instead:", err)
+		}
+		if _, ok := args["A"]; !ok {
+			t.Errorf("expected args to contain A, got instead: %s", m.Args)
+		}
+		if _, ok := args["B"]; !ok {
+			t.Errorf("expected args to contain B, got instead: %s", m.Args)
+		}
+		return
+	}
+	t.Errorf("expected Service1.Multiply to be listed, got instead: %+v", reply.Methods)
+}
+
+type Service3 struct {
+}
+
+func (t *Service3) Multiply(r *http.Request, req *Service1Request, res *Service1Response) error {
+	res.Result = -req.A * req.B
+	return nil
+}
+
+func TestRegisterDuplicateService(t *testing.T) {
+	s := newTestServer(t)
+	if err := s.RegisterService(new(Service1), "Foo"); err != nil {
+		t.Fatal("expected err to be nil, got instead:", err)
+	}
+	if !s.HasMethod("Service1.Multiply") || !s.HasMethod("Foo.Multiply") {
+		t.Error("expected both Service1.Multiply and Foo.Multiply to be registered")
+	}
+	if err := s.RegisterService(new(Service3), "Foo"); err == nil {
+		t.Error("expected err on duplicate service name Foo")
+	}
+	if err := s.RegisterService(new(Service1), ""); err == nil {
+		t.Error("expected err on duplicate service name Service1")
+	}
+	if err := s.ReplaceService(new(Service3), "Foo"); err != nil {
+		t.Fatal("expected err to be nil, got instead:", err)
+	}
+	w := serveTest(s, newTestRequest("Foo.Multiply", &Service1Request{4, 2}))
+	if body := w.Body.String(); !strings.Contains(body, `"Result":-8`) {
+		t.Errorf("expected Foo.Multiply to be replaced, got instead: %s", body)
+	}
+}
+
+type PositiveRequest struct {
+	A int
+	B int
+}
+
+func (r *PositiveRequest) Validate() error {
+	if r.A < 0 || r.B < 0 {
+		return errors.New("negative number")
+	}
+	return nil
+}
+
+type PositiveService struct {
+	calls int
+}
+
+func (t *PositiveService) Multiply(r *http.Request, req *PositiveRequest, res *Service1Response) error {
+	t.calls++
+	res.Result = req.A * req.B
+	return nil
+}
+
+func TestValidate(t *testing.T) {
+	s := newTestServer(t)
+	service := new(PositiveService)
+	s.RegisterService(service, "")
+	w := serveTest(s, newTestRequest("PositiveService.Multiply", &PositiveRequest{-4, 2}))
+	if w.Code != 400 {
+		t.Errorf("expected w.Code to be 400, got instead: %d", w.Code)
+	}
+	var res testResponse
+	if err := json.NewDecoder(w.Body).Decode(&res); err != nil || res.Error != "negative number" {
+		t.Errorf("expected codec encoded validation error, got instead: %+v (%v)", res, err)
+	}
+	if service.calls != 0 {
+		t.Errorf("expected method not to be called, got instead: %d calls", service.calls)
+	}
+	if w := serveTest(s, newTestRequest("PositiveService.Multiply", &PositiveRequest{4, 2})); w.Code != 200 {
+		t.Errorf("expected w.Code to be 200, got instead: %d", w.Code)
+	}
+	if service.calls != 1 {
+		t.Errorf("expected method to be called once, got instead: %d calls", service.calls)
+	}
+}
+
+func TestReturnedReply(t *testing.T) {
+	s := newTestServer(t)
+	if !s.HasMethod("Service1.Add") || !s.HasMethod("Service1.Difference") {
+		t.Fatal("expected to be registered: Service1.Add, Service1.Difference")
+	}
+	if w := serveTest(s, newTestRequest("Service1.Add", &Service1Request{4, 2})); !strings.Contains(w.Body.String(), `"Result":6`) {
+		t.Errorf("expected Service1.Add to return 6, got instead: %s", w.Body.String())
+	}
+	expected := serveTest(s, newTestRequest("Service1.Subtract", &Service1Request{4, 2})).Body.String()
+	if got := serveTest(s, newTestRequest("Service1.Difference", &Service1Request{4, 2})).Body.String(); got != expected {
+		t.Errorf("expected identical responses, got %q and %q", expected, got)
+	}
+}
+
+func TestTimeoutHeader(t *testing.T) {
+	s := newTestServer(t)
+	table := []struct {
+		timeout  string
+		duration time.Duration
+		code     int
+		body     string
+	}{
+		{"10ms", time.Second, 504, ErrTimeout.Error()},
+		{"1s", 0, 200, `"Deadline":true`},
+		{"soon", 20 * time.Millisecond, 200, `"Deadline":false`},
+		{"-1s", 20 * time.Millisecond, 200, `"Deadline":false`},
+	}
+	for _, exp := range table {
+		r := newTestRequest("Service1.Sleep", &SleepRequest{exp.duration})
+		r.Header.Set(TimeoutHeader, exp.timeout)
+		w := serveTest(s, r)
+		if w.Code != exp.code {
+			t.Errorf("expected w.Code to be %d for %q, got instead: %d", exp.code, exp.timeout, w.Code)
+		}
+		if !strings.Contains(w.Body.String(), exp.body) {
+			t.Errorf("expected body to contain %q for %q, got instead: %q", exp.body, exp.timeout, w.Body.String())
+		}
+	}
+	s.SetMaxTimeout(10 * time.Millisecond)
+	r := newTestRequest("Service1.Sleep", &SleepRequest{time.Second})
+	r.Header.Set(TimeoutHeader, "1h")
+	if w := serveTest(s, r); w.Code != 504 {
+		t.Errorf("expected w.Code to be 504 when capped, got instead: %d", w.Code)
+	}
+}
+
+type LoginRequest struct {
+	User     string
+	Password string
+}
+
+type LoginService struct {
+}
+
+func (t *LoginService) Login(r *http.Request, req *LoginRequest, res *Service1Response) error {
+	return nil
+}
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	s := newTestServer(t)
+	s.RegisterService(new(LoginService), "")
+	s.SetLogger(log.New(&buf, "", 0))
+	s.RedactFields("LoginService.Login", "Password")
+
+	serveTest(s, newTestRequest("LoginService.Login", &LoginRequest{"joe", "secret"}))
+	line := buf.String()
+	for _, exp := range []string{`method="LoginService.Login"`, "ip=127.0.0.1", "status=200", "User:joe", "Password:***"} {
+		if !strings.Contains(line, exp) {
+			t.Errorf("expected log to contain %q, got instead: %q", exp, line)
+		}
+	}
+	if strings.Contains(line, "secret") {
+		t.Errorf("expected secret to be redacted, got instead: %q", line)
+	}
+	buf.Reset()
+	serveTest(s, newTestRequest("Service1.Multiply", &Service1Request{4, 2}))
+	if line := buf.String(); !strings.Contains(line, `method="Service1.Multiply"`) || strings.Contains(line, "args=") {
+		t.Errorf("expected args not to be logged, got instead: %q", line)
+	}
+}
+
+type CaseService struct {
+}
+
+func (t *CaseService) Multiply(r *http.Request, req *Service1Request, res *Service1Response) error {
+	return nil
+}
+
+func (t *CaseService) MULTIPLY(r *http.Request, req *Service1Request, res *Service1Response) error {
+	return nil
+}
+
+func TestCaseInsensitiveMethods(t *testing.T) {
+	s := newTestServer(t)
+	if w := serveTest(s, newTestRequest("service1.multiply", &Service1Request{4, 2})); w.Code != 404 {
+		t.Errorf("expected w.Code to be 404, got instead: %d", w.Code)
+	}
+	s.SetCaseInsensitiveMethods(true)
+	w := serveTest(s, newTestRequest("service1.multiply", &Service1Request{4, 2}))
+	if w.Code != 200 || !strings.Contains(w.Body.String(), `"Result":8`) {
+		t.Errorf("expected service1.multiply to call Service1.Multiply, got instead: %d %s", w.Code, w.Body.String())
+	}
+	if !s.HasMethod("SERVICE1.Multiply") {
+		t.Error("expected to be registered: SERVICE1.Multiply")
+	}
+	if err := s.RegisterService(new(CaseService), ""); err == nil {
+		t.Error("expected err on methods differing only by case")
+	}
+	if err := s.RegisterService(new(Service3), "service1"); err == nil {
+		t.Error("expected err on services differing only by case")
+	}
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	s := newTestServer(t)
+	r := newTestRequest("Service1.Multiply", &Service1Request{4, 2})
+	r.Method = "PUT"
+	w := serveTest(s, r)
+	if w.Code != 405 {
+		t.Errorf("expected w.Code to be 405, got instead: %d", w.Code)
+	}
+	if allow := w.Header().Get("Allow"); allow != "POST, OPTIONS" {
+		t.Errorf("expected Allow header to be POST, OPTIONS, got instead: %q", allow)
+	}
+}
+
+func TestOptions(t *testing.T) {
+	s := newTestServer(t)
+	s.RegisterCodec(new(xmlCodec), "text/xml")
+	r := newTestRequest("", nil)
+	r.Method = "OPTIONS"
+	w := serveTest(s, r)
+	if w.Code != 200 {
+		t.Errorf("expected status 200, got instead: %d", w.Code)
+	}
+	if allow := w.Header().Get("Allow"); allow != "POST, OPTIONS" {
+		t.Errorf("expected Allow header to be POST, OPTIONS, got instead: %q", allow)
+	}
+	if body := w.Body.String(); body != "application/json\ntext/xml\n" {
+		t.Errorf("expected the codec content types, got instead: %q", body)
+	}
+}
+
+func TestReservedPrefix(t *testing.T) {
+	s := newTestServer(t)
+	if err := s.RegisterService(new(Service3), "rpc"); err == nil {
+		t.Error("expected err registering reserved service name rpc")
+	}
+	if err := s.RegisterService(new(Service3), "rpcthings"); err != nil {
+		t.Error("expected err to be nil, got instead:", err)
+	}
+	s.SetReservedPrefix("sys")
+	if err := s.RegisterService(new(Service3), "sys"); err == nil {
+		t.Error("expected err registering reserved service name sys")
+	}
+	if !s.HasMethod("rpc.listMethods") {
+		t.Error("expected to be registered: rpc.listMethods")
+	}
+}
+
+type ListService struct{}
+
+func (t *ListService) ListMethods(r *http.Request, req *ListMethodsArgs, res *ListMethodsReply) error {
+	return nil
+}
+
+func TestBuiltinCollision(t *testing.T) {
+	s := newTestServer(t)
+	err := s.RegisterService(new(ListService), "RPC")
+	if err == nil {
+		t.Fatal("expected err registering a method colliding with rpc.listMethods")
+	}
+	if msg := err.Error(); !strings.Contains(msg, `"RPC.ListMethods"`) || !strings.Contains(msg, `"rpc.listMethods"`) || !strings.Contains(msg, "rename") {
+		t.Errorf("expected err to name both methods and suggest a rename, got instead: %q", msg)
+	}
+	if err := s.RegisterService(new(ListService), "Lists"); err != nil {
+		t.Error("expected err to be nil, got instead:", err)
+	}
+}
+
+func TestContentType(t *testing.T) {
+	s := newTestServer(t)
+	table := []string{
+		"application/json",
+		"application/json ",
+		" application/json",
+		"Application/JSON; charset=UTF-8",
+		"application/json ; charset=utf-8",
+		"\tAPPLICATION/json\t;charset=utf-8",
+	}
+	for _, contentType := range table {
+		r := newTestRequest("Service1.Multiply", &Service1Request{4, 2})
+		r.Header.Set("Content-Type", contentType)
+		if w := serveTest(s, r); w.Code != 200 {
+			t.Errorf("expected w.Code to be 200 for %q, got instead: %d", contentType, w.Code)
+		}
+	}
+}
+
+func multiply(r *http.Request, req *Service1Request, res *Service1Response) error {
+	res.Result = req.A * req.B
+	return nil
+}
+
+func add(r *http.Request, req *Service1Request) (*Service1Response, error) {
+	return &Service1Response{req.A + req.B}, nil
+}
+
+func TestNamespacedService(t *testing.T) {
+	s := newTestServer(t)
+	if err := s.RegisterService(new(Service1), "Admin.Users"); err != nil {
+		t.Fatal("expected err to be nil, got instead:", err)
+	}
+	if w := serveTest(s, newTestRequest("Admin.Users.Multiply", &Service1Request{4, 2})); !strings.Contains(w.Body.String(), `"Result":8`) {
+		t.Errorf("expected namespaced method to be called, got instead: %q", w.Body.String())
+	}
+	if w := serveTest(s, newTestRequest("Admin.Multiply", &Service1Request{4, 2})); w.Code != 404 {
+		t.Errorf("expected w.Code to be 404, got instead: %d", w.Code)
+	}
+	for _, name := range []string{"Admin..Users", ".Users", "Admin."} {
+		if err := s.RegisterService(new(Service1), name); err == nil {
+			t.Errorf("expected registering %q to fail", name)
+		}
+	}
+}
+
+func TestRegisterFunc(t *testing.T) {
+	s := newTestServer(t)
+	if err := s.RegisterFunc("Math.Multiply", multiply); err != nil {
+		t.Fatal("expected err to be nil, got instead:", err)
+	}
+	if err := s.RegisterFunc("Math.Add", add); err != nil {
+		t.Fatal("expected err to be nil, got instead:", err)
+	}
+	if w := serveTest(s, newTestRequest("Math.Multiply", &Service1Request{4, 2})); !strings.Contains(w.Body.String(), `"Result":8`) {
+		t.Errorf("expected Math.Multiply to return 8, got instead: %s", w.Body.String())
+	}
+	if w := serveTest(s, newTestRequest("Math.Add", &Service1Request{4, 2})); !strings.Contains(w.Body.String(), `"Result":6`) {
+		t.Errorf("expected Math.Add to return 6, got instead: %s", w.Body.String())
+	}
+	table := []struct {
+		name string
+		fn   interface{}
+	}{
+		{"Math.Multiply", multiply},
+		{"Service1.Divide", multiply},
+		{"Multiply", multiply},
+		{"Math.Bad", func(req *Service1Request, res *Service1Response) error { return nil }},
+		{"Math.NotFunc", 42},
+	}
+	for _, exp := range table {
+		if err := s.RegisterFunc(exp.name, exp.fn); err == nil {
+			t.Errorf("expected err registering %s", exp.name)
+		}
+	}
+}
+
+func TestRegisterFuncs(t *testing.T) {
+	s := newTestServer(t)
+	if err := s.RegisterFuncs(map[string]interface{}{"Math.Multiply": multiply, "Math.Add": add}); err != nil {
+		t.Fatal("expected err to be nil, got instead:", err)
+	}
+	if w := serveTest(s, newTestRequest("Math.Multiply", &Service1Request{4, 2})); !strings.Contains(w.Body.String(), `"Result":8`) {
+		t.Errorf("expected Math.Multiply to return 8, got instead: %s", w.Body.String())
+	}
+	if w := serveTest(s, newTestRequest("Math.Add", &Service1Request{4, 2})); !strings.Contains(w.Body.String(), `"Result":6`) {
+		t.Errorf("expected Math.Add to return 6, got instead: %s", w.Body.String())
+	}
+	err := s.RegisterFuncs(map[string]interface{}{"Calc.Add": add, "Math.Sum": add, "Math.Multiply": multiply})
+	if err == nil {
+		t.Fatal("expected err registering Math.Multiply twice")
+	}
+	for _, method := range []string{"Calc.Add", "Math.Sum"} {
+		if w := serveTest(s, newTestRequest(method, &Service1Request{4, 2})); w.Code != 404 {
+			t.Errorf("expected %s to be rolled back, got instead: %d", method, w.Code)
+		}
+	}
+	if w := serveTest(s, newTestRequest("Math.Add", &Service1Request{4, 2})); !strings.Contains(w.Body.String(), `"Result":6`) {
+		t.Errorf("expected Math.Add to be kept, got instead: %s", w.Body.String())
+	}
+	if err := s.RegisterFuncs(map[string]interface{}{"Calc.Add": add, "Calc.Bad": 42}); err == nil {
+		t.Error("expected err registering a non function")
+	}
+}
+
+type ValueService struct {
+	Factor int
+}
+
+func (t ValueService) Multiply(r *http.Request, req *Service1Request, res *Service1Response) error {
+	res.Result = t.Factor * req.A * req.B
+	return nil
+}
+
+func (t *ValueService) Add(r *http.Request, req *Service1Request, res *Service1Response) error {
+	res.Result = t.Factor * (req.A + req.B)
+	return nil
+}
+
+func TestValueReceiver(t *testing.T) {
+	s := newTestServer(t)
+	if err := s.RegisterService(ValueService{10}, ""); err != nil {
+		t.Fatal("expected err to be nil, got instead:", err)
+	}
+	if w := serveTest(s, newTestRequest("ValueService.Multiply", &Service1Request{4, 2})); !strings.Contains(w.Body.String(), `"Result":80`) {
+		t.Errorf("expected ValueService.Multiply to return 80, got instead: %s", w.Body.String())
+	}
+	if w := serveTest(s, newTestRequest("ValueService.Add", &Service1Request{4, 2})); !strings.Contains(w.Body.String(), `"Result":60`) {
+		t.Errorf("expected ValueService.Add to return 60, got instead: %s", w.Body.String())
+	}
+}
+
+func TestServiceCodec(t *testing.T) {
+	s := newTestServer(t)
+	if err := s.RegisterServiceWithCodec(new(Service3), "", new(xmlCodec)); err != nil {
+		t.Fatal("expected err to be nil, got instead:", err)
+	}
+	w := serveTest(s, newTestRequest("Service3.Multiply", &Service1Request{4, 2}))
+	if ct := w.Header().Get("Content-Type"); ct != "text/xml" {
+		t.Errorf("expected Content-Type to be text/xml, got instead: %q", ct)
+	}
+	if body := w.Body.String(); body != "<Service1Response><Result>-8</Result></Service1Response>" {
+		t.Errorf("expected XML response, got instead: %q", body)
+	}
+	if w := serveTest(s, newTestRequest("Service1.Multiply", &Service1Request{4, 2})); w.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("expected other services to respond JSON, got instead: %q", w.Body.String())
+	}
+}
+
+func TestResponseCodecHeader(t *testing.T) {
+	s := newTestServer(t)
+	s.RegisterService(new(Service3), "")
+	s.RegisterCodec(new(headerCodec), "application/msgpack")
+	s.RegisterCodec(new(xmlEncoder), "text/xml")
+	s.RegisterCodec(new(xmlCodec), "application/xml")
+	send := func(codec string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(&Service1Request{4, 2})
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewReader(body))
+		r.Header.Set("Content-Type", "application/msgpack")
+		r.Header.Set("X-RPC-Method", "Service3.Multiply")
+		r.Header.Set(ResponseCodecHeader, codec)
+		r.RemoteAddr = "127.0.0.1:8080"
+		return serveTest(s, r)
+	}
+	w := send("text/xml")
+	if ct := w.Header().Get("Content-Type"); ct != "text/xml" {
+		t.Errorf("expected Content-Type to be text/xml, got instead: %q", ct)
+	}
+	if body := w.Body.String(); body != "<Service1Response><Result>-8</Result></Service1Response>" {
+		t.Errorf("expected XML response, got instead: %q", body)
+	}
+	for _, codec := range []string{"application/unknown", "application/xml"} {
+		if w := send(codec); w.Code != 200 || !strings.Contains(w.Body.String(), `"Result":-8`) {
+			t.Errorf("expected %s to be ignored, got instead: %d %q", codec, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestInvoke(t *testing.T) {
+	s := newTestServer(t)
+	reply, err := s.Invoke("Service1.Multiply", &Service1Request{4, 2})
+	if err != nil {
+		t.Fatal("expected err to be nil, got instead:", err)
+	}
+	if res, ok := reply.(*Service1Response); !ok || res.Result != 8 {
+		t.Errorf("expected &{8}, got instead: %#v", reply)
+	}
+	if reply, err := s.Invoke("Service1.Multiply", Service1Request{3, 3}); err != nil || reply.(*Service1Response).Result != 9 {
+		t.Errorf("expected 9 passing args by value, got instead: %#v (%v)", reply, err)
+	}
+	if _, err := s.Invoke("Service1.Multiply", 42); err == nil {
+		t.Error("expected an error for args of the wrong type")
+	}
+	if _, err := s.Invoke("Service1.Nope", &Service1Request{}); err == nil {
+		t.Error("expected an error for an unknown method")
+	}
+}
+
+func TestMethodInfo(t *testing.T) {
+	s := newTestServer(t)
+	argsType, replyType, ok := s.MethodInfo("Service1.Multiply")
+	if !ok {
+		t.Fatal("expected Service1.Multiply to be found")
+	}
+	if argsType != reflect.TypeOf(Service1Request{}) {
+		t.Errorf("expected args type Service1Request, got instead: %v", argsType)
+	}
+	if replyType != reflect.TypeOf(Service1Response{}) {
+		t.Errorf("expected reply type Service1Response, got instead: %v", replyType)
+	}
+	if _, _, ok := s.MethodInfo("Service1.Nope"); ok {
+		t.Error("expected Service1.Nope not to be found")
+	}
+}
+
+func TestDebugSuggestions(t *testing.T) {
+	s := newTestServer(t)
+	r := newTestRequest("Service1.Multply", &Service1Request{4, 2})
+	if w := serveTest(s, r); strings.Contains(w.Body.String(), "did you mean") {
+		t.Errorf("expected no suggestion without debug, got instead: %q", w.Body.String())
+	}
+	s.SetDebug(true)
+	w := serveTest(s, newTestRequest("Service1.Multply", &Service1Request{4, 2}))
+	if w.Code != 404 {
+		t.Errorf("expected w.Code to be 404, got instead: %d", w.Code)
+	}
+	if body := w.Body.String(); !strings.Contains(body, `did you mean "Service1.Multiply"?`) {
+		t.Errorf("expected Service1.Multiply to be suggested, got instead: %q", body)
+	}
+	w = serveTest(s, newTestRequest("Nothing.Similar", &Service1Request{4, 2}))
+	if body := w.Body.String(); strings.Contains(body, "did you mean") {
+		t.Errorf("expected no suggestion, got instead: %q", body)
+	}
+}
+
+func TestBeforeAfterFuncs(t *testing.T) {
+	var before, after []*RequestInfo
+	s := newTestServer(t)
+	service := new(Service3)
+	s.RegisterService(service, "Foo")
+	s.RegisterBeforeFunc(func(i *RequestInfo) error {
+		before = append(before, i)
+		if i.Service == "Service1" {
+			return errors.New("denied")
+		}
+		return nil
+	})
+	s.RegisterAfterFunc(func(i *RequestInfo) {
+		after = append(after, i)
+	})
+
+	if w := serveTest(s, newTestRequest("Foo.Multiply", &Service1Request{4, 2})); w.Code != 200 {
+		t.Errorf("expected w.Code to be 200, got instead: %d", w.Code)
+	}
+	if w := serveTest(s, newTestRequest("Service1.Multiply", &Service1Request{4, 2})); w.Code != 403 {
+		t.Errorf("expected w.Code to be 403, got instead: %d", w.Code)
+	}
+	if len(before) != 2 || len(after) != 2 {
+		t.Fatalf("expected 2 before and after calls, got instead: %d, %d", len(before), len(after))
+	}
+	if i := before[0]; i.Service != "Foo" || i.Method != "Foo.Multiply" || i.Receiver.Interface() != service {
+		t.Errorf("expected before func to see service Foo, got instead: %+v", i)
+	}
+	if i := after[0]; i.Service != "Foo" || i.StatusCode != 200 || i.Error != nil {
+		t.Errorf("expected after func to see successful Foo call, got instead: %+v", i)
+	}
+	if i := after[1]; i.Service != "Service1" || i.StatusCode != 403 || i.Error == nil {
+		t.Errorf("expected after func to see rejected Service1 call, got instead: %+v", i)
+	}
+}
+
+type BlockService struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (t *BlockService) Block(r *http.Request, req *Service1Request, res *Service1Response) error {
+	t.started <- struct{}{}
+	<-t.release
+	return nil
+}
+
+func newBlockService() *BlockService {
+	return &BlockService{make(chan struct{}), make(chan struct{})}
+}
+
+func TestTimeoutHoldsSlots(t *testing.T) {
+	for _, limit := range []struct {
+		set    func(s *Server)
+		status int
+	}{
+		{func(s *Server) { s.SetMaxConcurrent(1) }, 503},
+		{func(s *Server) { s.SetMaxConcurrentPerIP(1) }, 429},
+	} {
+		s := newTestServer(t)
+		block := newBlockService()
+		s.RegisterService(block, "")
+		limit.set(s)
+		r := newTestRequest("BlockService.Block", &Service1Request{})
+		r.Header.Set(TimeoutHeader, "1ms")
+		if w := serveTest(s, r); w.Code != 504 {
+			t.Fatalf("expected w.Code to be 504, got instead: %d", w.Code)
+		}
+		<-block.started
+		if w := serveTest(s, newTestRequest("Service1.Multiply", &Service1Request{4, 2})); w.Code != limit.status {
+			t.Errorf("expected w.Code to be %d while the timed out method runs, got instead: %d", limit.status, w.Code)
+		}
+		close(block.release)
+		code := 0
+		for i := 0; i < 100 && code != 200; i++ {
+			time.Sleep(time.Millisecond)
+			code = serveTest(s, newTestRequest("Service1.Multiply", &Service1Request{4, 2})).Code
+		}
+		if code != 200 {
+			t.Errorf("expected the slot to be released once the method returned, got instead: %d", code)
+		}
+	}
+}
+
+func TestTimeoutWait(t *testing.T) {
+	s := newTestServer(t)
+	block := newBlockService()
+	s.RegisterService(block, "")
+	var info *RequestInfo
+	s.RegisterAfterFunc(func(i *RequestInfo) { info = i })
+	r := newTestRequest("BlockService.Block", &Service1Request{})
+	r.Header.Set(TimeoutHeader, "1ms")
+	if w := serveTest(s, r); w.Code != 504 {
+		t.Fatalf("expected w.Code to be 504, got instead: %d", w.Code)
+	}
+	if info == nil || info.Args.IsValid() {
+		t.Errorf("expected the after functions not to get the args of a running method, got instead: %+v", info)
+	}
+	<-block.started
+	if n := s.InFlight(); n != 1 {
+		t.Errorf("expected the timed out method to be in flight, got instead: %d", n)
+	}
+	s.Drain()
+	waited := make(chan struct{})
+	go func() {
+		s.Wait()
+		close(waited)
+	}()
+	select {
+	case <-waited:
+		t.Error("expected Wait to block until the timed out method returns")
+	case <-time.After(10 * time.Millisecond):
+	}
+	close(block.release)
+	select {
+	case <-waited:
+	case <-time.After(time.Second):
+		t.Fatal("expected Wait to return once the method returned")
+	}
+	n := s.InFlight()
+	for i := 0; i < 100 && n != 0; i++ {
+		time.Sleep(time.Millisecond)
+		n = s.InFlight()
+	}
+	if n != 0 {
+		t.Errorf("expected no request in flight, got instead: %d", n)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	s := newTestServer(t)
+	service := newBlockService()
+	s.RegisterService(service, "")
+
+	served := make(chan int)
+	go func() {
+		served <- serveTest(s, newTestRequest("BlockService.Block", &Service1Request{})).Code
+	}()
+	<-service.started
+	s.Drain()
+	if w := serveTest(s, newTestRequest("Service1.Multiply", &Service1Request{4, 2})); w.Code != 503 {
+		t.Errorf("expected w.Code to be 503, got instead: %d", w.Code)
+	}
+	waited := make(chan struct{})
+	go func() {
+		s.Wait()
+		close(waited)
+	}()
+	select {
+	case <-waited:
+		t.Fatal("expected Wait to block while a request is in flight")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(service.release)
+	if code := <-served; code != 200 {
+		t.Errorf("expected in flight request status to be 200, got instead: %d", code)
+	}
+	select {
+	case <-waited:
+	case <-time.After(time.Second):
+		t.Fatal("expected Wait to return after the request was served")
+	}
+}
+
+func TestInFlight(t *testing.T) {
+	s := newTestServer(t)
+	service := newBlockService()
+	s.RegisterService(service, "")
+
+	served := make(chan struct{})
+	go func() {
+		serveTest(s, newTestRequest("BlockService.Block", &Service1Request{}))
+		close(served)
+	}()
+	<-service.started
+	if n := s.InFlight(); n != 1 {
+		t.Errorf("expected InFlight to be 1, got instead: %d", n)
+	}
+	close(service.release)
+	<-served
+	if n := s.InFlight(); n != 0 {
+		t.Errorf("expected InFlight to be 0, got instead: %d", n)
+	}
+}
+
+func TestMaxConcurrent(t *testing.T) {
+	const n = 2
+	s := newTestServer(t)
+	service := newBlockService()
+	s.RegisterService(service, "")
+	s.SetMaxConcurrent(n)
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serveTest(s, newTestRequest("BlockService.Block", &Service1Request{}))
+		}()
+		<-service.started
+	}
+	w := serveTest(s, newTestRequest("Service1.Multiply", &Service1Request{4, 2}))
+	if w.Code != 503 {
+		t.Errorf("expected w.Code to be 503, got instead: %d", w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("expected Retry-After header to be set")
+	}
+	for i := 0; i < n; i++ {
+		service.release <- struct{}{}
+	}
+	wg.Wait()
+	if w := serveTest(s, newTestRequest("Service1.Multiply", &Service1Request{4, 2})); w.Code != 200 {
+		t.Errorf("expected w.Code to be 200, got instead: %d", w.Code)
+	}
+}
+
+func TestMaxConcurrentPerIP(t *testing.T) {
+	s := newTestServer(t)
+	service := newBlockService()
+	s.RegisterService(service, "")
+	s.SetMaxConcurrent(10)
+	s.SetMaxConcurrentPerIP(1)
+	send := func(addr string) *httptest.ResponseRecorder {
+		r := newTestRequest("Service1.Multiply", &Service1Request{4, 2})
+		r.RemoteAddr = addr
+		return serveTest(s, r)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		r := newTestRequest("BlockService.Block", &Service1Request{})
+		r.RemoteAddr = "10.0.0.1:8080"
+		serveTest(s, r)
+		close(done)
+	}()
+	<-service.started
+	if w := send("10.0.0.1:8081"); w.Code != 429 {
+		t.Errorf("expected w.Code to be 429, got instead: %d", w.Code)
+	}
+	if w := send("10.0.0.2:8080"); w.Code != 200 {
+		t.Errorf("expected another client to be served, got instead: %d", w.Code)
+	}
+	close(service.release)
+	<-done
+	if w := send("10.0.0.1:8081"); w.Code != 200 {
+		t.Errorf("expected w.Code to be 200, got instead: %d", w.Code)
+	}
+}
+
+func TestMaxConcurrentDenied(t *testing.T) {
+	s := newTestServer(t)
+	service := newBlockService()
+	s.RegisterService(service, "")
+	s.SetMaxConcurrent(1)
+	s.Bind(net.ParseIP("127.0.0.1"))
+
+	r := newTestRequest("Service1.Multiply", &Service1Request{4, 2})
+	r.RemoteAddr = "10.0.0.1:8080"
+	if w := serveTest(s, r); w.Code != 403 {
+		t.Errorf("expected w.Code to be 403, got instead: %d", w.Code)
+	}
+	if w := serveTest(s, newTestRequest("Service1.Multiply", &Service1Request{4, 2})); w.Code != 200 {
+		t.Errorf("expected the slot to be free, got instead: %d", w.Code)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		serveTest(s, newTestRequest("BlockService.Block", &Service1Request{}))
+		close(done)
+	}()
+	<-service.started
+	r = newTestRequest("Service1.Multiply", &Service1Request{4, 2})
+	r.RemoteAddr = "10.0.0.1:8080"
+	if w := serveTest(s, r); w.Code != 403 {
+		t.Errorf("expected a denied client to get 403 while at capacity, got instead: %d", w.Code)
+	}
+	close(service.release)
+	<-done
+}
+
+type PDFResponse struct {
+	Data []byte
+}
+
+func (p *PDFResponse) ContentType() string {
+	return "application/pdf"
+}
+
+func (p *PDFResponse) Body() []byte {
+	return p.Data
+}
+
+func (t *Service1) Render(r *http.Request, req *Service1Request, res *PDFResponse) error {
+	res.Data = []byte("%PDF-1.4\x00\x01")
+	return nil
+}
+
+func TestRawResponder(t *testing.T) {
+	s := newTestServer(t)
+	w := serveTest(s, newTestRequest("Service1.Render", &Service1Request{}))
+	if ct := w.Header().Get("Content-Type"); ct != "application/pdf" {
+		t.Errorf("expected Content-Type to be application/pdf, got instead: %q", ct)
+	}
+	if body := w.Body.String(); body != "%PDF-1.4\x00\x01" {
+		t.Errorf("expected raw body, got instead: %q", body)
+	}
+}
+
+func TestServiceNamer(t *testing.T) {
+	s := newTestServer(t)
+	if err := s.RegisterServiceWithNamer(new(Service1), "service1", strings.ToLower); err != nil {
+		t.Fatal("expected err to be nil, got instead:", err)
+	}
+	if !s.HasMethod("service1.multiply") || s.HasMethod("service1.Multiply") {
+		t.Error("expected to be registered as service1.multiply only")
+	}
+	if w := serveTest(s, newTestRequest("service1.multiply", &Service1Request{4, 2})); !strings.Contains(w.Body.String(), `"Result":8`) {
+		t.Errorf("expected service1.multiply to return 8, got instead: %s", w.Body.String())
+	}
+	constant := func(string) string { return "same" }
+	if err := s.RegisterServiceWithNamer(new(Service1), "Bar", constant); err == nil {
+		t.Error("expected err when methods are mapped to the same name")
+	}
+}
+
+type AcceptedResponse struct {
+	Token string
+}
+
+func (a *AcceptedResponse) StatusCode() int {
+	return 202
+}
+
+func (t *Service1) Start(r *http.Request, req *Service1Request, res *AcceptedResponse) error {
+	res.Token = "job-1"
+	return nil
+}
+
+func (t *Service1) Fail(r *http.Request, req *Service1Request, res *AcceptedResponse) error {
+	return errors.New("failed")
+}
+
+func TestStatusCoder(t *testing.T) {
+	s := newTestServer(t)
+	w := serveTest(s, newTestRequest("Service1.Start", &Service1Request{}))
+	if w.Code != 202 {
+		t.Errorf("expected w.Code to be 202, got instead: %d", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), `"Token":"job-1"`) {
+		t.Errorf("expected reply to be encoded, got instead: %s", w.Body.String())
+	}
+	if w := serveTest(s, newTestRequest("Service1.Fail", &Service1Request{})); w.Code != 200 {
+		t.Errorf("expected w.Code to be 200 on error, got instead: %d", w.Code)
+	}
+}
+
+func TestMethodHandler(t *testing.T) {
+	s := newTestServer(t)
+	h, err := s.MethodHandler("Service1.Multiply")
+	if err != nil {
+		t.Fatal("expected err to be nil, got instead:", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/multiply", h)
+	buf, _ := json.Marshal(map[string]interface{}{"params": &Service1Request{4, 2}})
+	r, _ := http.NewRequest("POST", "http://localhost:8080/multiply", bytes.NewReader(buf))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if w.Code != 200 || !strings.Contains(w.Body.String(), `"Result":8`) {
+		t.Errorf("expected /multiply to return 8, got instead: %d %s", w.Code, w.Body.String())
+	}
+	if _, err := s.MethodHandler("Service1.Divide"); err == nil {
+		t.Error("expected err for unregistered method")
+	}
+}
+
+type CancelService struct {
+	cancel context.CancelFunc
+}
+
+func (t *CancelService) Work(r *http.Request, req *Service1Request, res *Service1Response) error {
+	// Simulates the client disconnecting while the method runs.
+	t.cancel()
+	return nil
+}
+
+func TestClientCanceled(t *testing.T) {
+	var canceled, status int
+	s := newTestServer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	s.RegisterService(&CancelService{cancel}, "")
+	s.SetCancelFunc(func(i *RequestInfo) {
+		canceled++
+	})
+	s.SetMetricsObserver(func(method string, code int, latency time.Duration, err error) {
+		status = code
+	})
+	for _, timeout := range []string{"", "1s"} {
+		canceled = 0
+		r := newTestRequest("CancelService.Work", &Service1Request{})
+		r.Header.Set(TimeoutHeader, timeout)
+		w := serveTest(s, r.WithContext(ctx))
+		if w.Code == 400 || w.Code == 504 || w.Body.Len() != 0 {
+			t.Errorf("expected no response to be written, got instead: %d %q", w.Code, w.Body.String())
+		}
+		if canceled != 1 {
+			t.Errorf("expected cancel func to be called once, got instead: %d", canceled)
+		}
+		if status != StatusClientClosedRequest {
+			t.Errorf("expected status to be %d, got instead: %d", StatusClientClosedRequest, status)
+		}
+	}
+}
+
+func TestTransportErrorFormat(t *testing.T) {
+	s := newTestServer(t)
+	r := newTestRequest("Service1.Multiply", &Service1Request{A: 2, B: 3})
+	r.Header.Set("Content-Type", "text/csv")
+	w := serveTest(s, r)
+	if w.Code != 415 {
+		t.Fatalf("expected status 415, got instead: %d", w.Code)
+	}
+	if ct := w.Result().Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("expected plain text error, got instead: %q", ct)
+	}
+
+	s.SetTransportErrorFormat(TransportErrorJSON)
+	w = serveTest(s, r)
+	if w.Code != 415 {
+		t.Fatalf("expected status 415, got instead: %d", w.Code)
+	}
+	if ct := w.Result().Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+		t.Errorf("expected JSON error, got instead: %q", ct)
+	}
+	var body struct {
+		Error struct {
+			Code    int
+			Message string
+		}
+	}
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatal("expected err to be nil, got instead:", err)
+	}
+	if body.Error.Code != 415 || body.Error.Message != "rpc: unrecognized Content-Type: text/csv" {
+		t.Errorf("unexpected error object: %+v", body.Error)
+	}
+}
+
+type RepeatService struct{}
+
+func (t *RepeatService) Repeat(r *http.Request, req *Service1Request, res *string) error {
+	*res = strings.Repeat("x", req.A)
+	return nil
+}
+
+func TestGzipMinSize(t *testing.T) {
+	s := newTestServer(t)
+	s.RegisterService(new(RepeatService), "")
+	send := func(n int) *httptest.ResponseRecorder {
+		r := newTestRequest("RepeatService.Repeat", &Service1Request{A: n})
+		r.Header.Set("Accept-Encoding", "gzip, deflate")
+		return serveTest(s, r)
+	}
+	if w := send(1000); w.Header().Get("Content-Encoding") != "" {
+		t.Errorf("expected no compression by default, got instead: %q", w.Header().Get("Content-Encoding"))
+	}
+
+	s.SetGzipMinSize(200)
+	w := send(10)
+	if enc := w.Header().Get("Content-Encoding"); enc != "" {
+		t.Errorf("expected small reply to be uncompressed, got instead: %q", enc)
+	}
+	if !strings.Contains(w.Body.String(), `"xxxxxxxxxx"`) {
+		t.Errorf("expected plain reply, got instead: %q", w.Body.String())
+	}
+
+	w = send(1000)
+	if enc := w.Header().Get("Content-Encoding"); enc != "gzip" {
+		t.Fatalf("expected large reply to be gzipped, got instead: %q", enc)
+	}
+	gz, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal("expected err to be nil, got instead:", err)
+	}
+	body, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatal("expected err to be nil, got instead:", err)
+	}
+	if !strings.Contains(string(body), strings.Repeat("x", 1000)) {
+		t.Errorf("expected decompressed reply, got instead: %q", body)
+	}
+
+	r := newTestRequest("RepeatService.Repeat", &Service1Request{A: 1000})
+	r.Header.Set("Accept-Encoding", "gzip;q=0")
+	if enc := serveTest(s, r).Header().Get("Content-Encoding"); enc != "" {
+		t.Errorf("expected reply to be uncompressed when gzip is refused, got instead: %q", enc)
+	}
+}
+
+func TestResponseHeaders(t *testing.T) {
+	s := newTestServer(t)
+	s.SetResponseHeaders(http.Header{"x-frame-options": {"DENY"}})
+	w := serveTest(s, newTestRequest("Service1.Multiply", &Service1Request{4, 2}))
+	if h := w.Header().Get("X-Frame-Options"); h != "DENY" {
+		t.Errorf("expected X-Frame-Options to be DENY, got instead: %q", h)
+	}
+	if h := w.Header().Get("X-Content-Type-Options"); h != "nosniff" {
+		t.Errorf("expected X-Content-Type-Options to be nosniff, got instead: %q", h)
+	}
+
+	s.SetResponseHeaders(http.Header{"X-Content-Type-Options": nil})
+	w = serveTest(s, newTestRequest("Service1.Multiply", &Service1Request{4, 2}))
+	if _, ok := w.Header()["X-Content-Type-Options"]; ok {
+		t.Errorf("expected X-Content-Type-Options to be removed, got instead: %q", w.Header().Get("X-Content-Type-Options"))
+	}
+}
+
+func TestSniffEncoding(t *testing.T) {
+	s := newTestServer(t)
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	json.NewEncoder(gz).Encode(map[string]interface{}{"method": "Service1.Multiply", "params": &Service1Request{4, 2}})
+	gz.Close()
+	send := func() *httptest.ResponseRecorder {
+		r := newTestRequest("", nil)
+		r.Body = ioutil.NopCloser(bytes.NewReader(buf.Bytes()))
+		return serveTest(s, r)
+	}
+	if w := send(); w.Code != 400 {
+		t.Errorf("expected w.Code to be 400 without sniffing, got instead: %d", w.Code)
+	}
+
+	s.SetSniffEncoding(true)
+	if w := send(); w.Code != 200 || !strings.Contains(w.Body.String(), `"Result":8`) {
+		t.Errorf("expected gzip body to be decompressed, got instead: %d %q", w.Code, w.Body.String())
+	}
+	if w := serveTest(s, newTestRequest("Service1.Multiply", &Service1Request{4, 2})); !strings.Contains(w.Body.String(), `"Result":8`) {
+		t.Errorf("expected plain body to be read unchanged, got instead: %q", w.Body.String())
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	s := newTestServer(t)
+	s.SetRequestID(true)
+	var ids []string
+	s.RegisterBeforeFunc(func(i *RequestInfo) error {
+		ids = append(ids, i.RequestID)
+		return nil
+	})
+
+	r := newTestRequest("Service1.Multiply", &Service1Request{4, 2})
+	r.Header.Set(RequestIDHeader, "abc-123")
+	if id := serveTest(s, r).Header().Get(RequestIDHeader); id != "abc-123" {
+		t.Errorf("expected request id to be echoed, got instead: %q", id)
+	}
+	id := serveTest(s, newTestRequest("Service1.Multiply", &Service1Request{4, 2})).Header().Get(RequestIDHeader)
+	if len(id) != 32 {
+		t.Errorf("expected a generated request id, got instead: %q", id)
+	}
+	if len(ids) != 2 || ids[0] != "abc-123" || ids[1] != id {
+		t.Errorf("expected hooks to get the request ids, got instead: %q", ids)
+	}
+}
+
+type InfoService struct {
+	info *CallInfo
+	ok   bool
+}
+
+func (t *InfoService) Whoami(r *http.Request, req *Service1Request, res *Service1Response) error {
+	t.info, t.ok = FromContext(r.Context())
+	return nil
+}
+
+func TestFromContext(t *testing.T) {
+	s := newTestServer(t)
+	service := new(InfoService)
+	s.RegisterService(service, "Info")
+
+	serveTest(s, newTestRequest("Info.Whoami", &Service1Request{}))
+	if service.ok {
+		t.Errorf("expected no call info by default, got instead: %+v", service.info)
+	}
+
+	s.SetCallInfo(true)
+	serveTest(s, newTestRequest("Info.Whoami", &Service1Request{}))
+	if !service.ok {
+		t.Fatal("expected call info in the request context")
+	}
+	if service.info.Method != "Info.Whoami" || service.info.Service != "Info" {
+		t.Errorf("expected Info.Whoami method of Info service, got instead: %+v", service.info)
+	}
+	if !service.info.RemoteIP.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("expected remote IP 127.0.0.1, got instead: %v", service.info.RemoteIP)
+	}
+	if service.info.ContentType != "application/json" {
+		t.Errorf("expected application/json content type, got instead: %q", service.info.ContentType)
+	}
+}
+
+func TestMethodRewriter(t *testing.T) {
+	s := newTestServer(t)
+	s.RegisterService(new(Service3), "NewService")
+	var called string
+	s.SetMetricsObserver(func(method string, status int, latency time.Duration, err error) {
+		called = method
+	})
+	s.SetMethodRewriter(func(method string) string {
+		if method == "OldService.Do" {
+			return "NewService.Multiply"
+		}
+		return method
+	})
+	w := serveTest(s, newTestRequest("OldService.Do", &Service1Request{4, 2}))
+	if w.Code != 200 || !strings.Contains(w.Body.String(), `"Result":-8`) {
+		t.Errorf("expected NewService.Multiply to be called, got instead: %d %q", w.Code, w.Body.String())
+	}
+	if called != "NewService.Multiply" {
+		t.Errorf("expected the rewritten method to be observed, got instead: %q", called)
+	}
+	if w := serveTest(s, newTestRequest("Service1.Multiply", &Service1Request{4, 2})); w.Code != 200 || !strings.Contains(w.Body.String(), `"Result":8`) {
+		t.Errorf("expected other methods to be left untouched, got instead: %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestClientCertVerifier(t *testing.T) {
+	s := newTestServer(t)
+	s.SetClientCertVerifier(func(state *tls.ConnectionState) error {
+		for _, chain := range state.VerifiedChains {
+			if len(chain) > 0 && chain[0].Subject.CommonName == "billing" {
+				return nil
+			}
+		}
+		return errors.New("rpc: client certificate not authorized")
+	})
+	send := func(state *tls.ConnectionState) *httptest.ResponseRecorder {
+		r := newTestRequest("Service1.Multiply", &Service1Request{4, 2})
+		r.TLS = state
+		return serveTest(s, r)
+	}
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "billing"}}
+	if w := send(&tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}); w.Code != 200 {
+		t.Errorf("expected w.Code to be 200 for a verified chain, got instead: %d", w.Code)
+	}
+	if w := send(&tls.ConnectionState{}); w.Code != 403 || !strings.Contains(w.Body.String(), "not authorized") {
+		t.Errorf("expected 403 for an empty state, got instead: %d %q", w.Code, w.Body.String())
+	}
+	if w := send(nil); w.Code != 403 || !strings.Contains(w.Body.String(), ErrTLSRequired.Error()) {
+		t.Errorf("expected 403 and %q without TLS, got instead: %d %q", ErrTLSRequired, w.Code, w.Body.String())
+	}
+}
+
+func TestTrustForwardedFor(t *testing.T) {
+	s := newTestServer(t)
+	service := new(InfoService)
+	s.RegisterService(service, "Info")
+	s.SetCallInfo(true)
+	whoami := func(remoteAddr string, forwarded ...string) net.IP {
+		r := newTestRequest("Info.Whoami", &Service1Request{})
+		r.RemoteAddr = remoteAddr
+		for _, hops := range forwarded {
+			r.Header.Add("X-Forwarded-For", hops)
+		}
+		service.info = nil
+		if w := serveTest(s, r); w.Code != 200 {
+			t.Fatalf("expected w.Code to be 200, got instead: %d", w.Code)
+		}
+		return service.info.RemoteIP
+	}
+	if ip := whoami("[fe80::1%eth0]:8080", "203.0.113.7"); !ip.Equal(net.ParseIP("fe80::1")) {
+		t.Errorf("expected fe80::1 with no trusted proxy, got instead: %v", ip)
+	}
+	s.TrustForwardedFor(mustParseCIDRs("10.0.0.0/8")...)
+	table := []struct {
+		remoteAddr string
+		forwarded  []string
+		ip         string
+	}{
+		{"10.0.0.1:8080", []string{"203.0.113.7"}, "203.0.113.7"},
+		{"10.0.0.1:8080", []string{"198.51.100.1, 203.0.113.7, 10.0.0.2"}, "203.0.113.7"},
+		{"10.0.0.1:8080", []string{"198.51.100.1", "203.0.113.7"}, "203.0.113.7"},
+		{"10.0.0.1:8080", []string{"bogus, 10.0.0.2"}, "10.0.0.2"},
+		{"10.0.0.1:8080", nil, "10.0.0.1"},
+		{"192.0.2.1:8080", []string{"203.0.113.7"}, "192.0.2.1"},
+	}
+	for _, test := range table {
+		if ip := whoami(test.remoteAddr, test.forwarded...); !ip.Equal(net.ParseIP(test.ip)) {
+			t.Errorf("expected %s for %s forwarding %q, got instead: %v", test.ip, test.remoteAddr, test.forwarded, ip)
+		}
+	}
+	s.Bind(net.ParseIP("203.0.113.7"))
+	r := newTestRequest("Info.Whoami", &Service1Request{})
+	r.RemoteAddr = "10.0.0.1:8080"
+	r.Header.Set("X-Forwarded-For", "198.51.100.1")
+	if w := serveTest(s, r); w.Code != 403 {
+		t.Errorf("expected the forwarded IP to be checked by Bind, got instead: %d", w.Code)
+	}
+}
+
+type GatewayService struct {
+	requested string
+}
+
+func (t *GatewayService) Catchall(r *http.Request, req *json.RawMessage, res *string) error {
+	t.requested = RequestedMethod(r.Context())
+	*res = "handled " + t.requested
+	return nil
+}
+
+func TestFallbackMethod(t *testing.T) {
+	s := newTestServer(t)
+	service := new(GatewayService)
+	s.RegisterService(service, "Gateway")
+	if w := serveTest(s, newTestRequest("Legacy.Lookup", &Service1Request{})); w.Code != 404 {
+		t.Errorf("expected status 404 without fallback, got instead: %d", w.Code)
+	}
+	if err := s.SetFallbackMethod("Gateway.Missing"); err == nil {
+		t.Error("expected err for an unregistered fallback method")
+	}
+	if err := s.SetFallbackMethod("Gateway.Catchall"); err != nil {
+		t.Fatal("expected err to be nil, got instead:", err)
+	}
+	w := serveTest(s, newTestRequest("Legacy.Lookup", &Service1Request{}))
+	if w.Code != 200 || service.requested != "Legacy.Lookup" {
+		t.Errorf("expected fallback to see Legacy.Lookup, got instead: %d %q", w.Code, service.requested)
+	}
+	w = serveTest(s, newTestRequest("Service1.Multiply", &Service1Request{4, 2}))
+	if !strings.Contains(w.Body.String(), `"Result":8`) {
+		t.Errorf("expected Service1.Multiply to be called, got instead: %s", w.Body.String())
+	}
+	if service.requested != "Legacy.Lookup" {
+		t.Errorf("expected fallback not to be called, got instead: %q", service.requested)
+	}
+}
+
+type EventService struct{}
+
+func (t *EventService) Events(w http.ResponseWriter, r *http.Request, req *Service1Request) error {
+	if req.A < 0 {
+		return errors.New("no events")
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	for i := 1; i <= req.A; i++ {
+		fmt.Fprintf(w, "data: event %d\n\n", i)
+		w.(http.Flusher).Flush()
+	}
+	return nil
+}
+
+func TestResponseWriterMethod(t *testing.T) {
+	s := newTestServer(t)
+	if err := s.RegisterService(new(EventService), ""); err != nil {
+		t.Fatal("expected err to be nil, got instead:", err)
+	}
+	w := serveTest(s, newTestRequest("EventService.Events", &Service1Request{A: 2}))
+	if ct := w.Header().Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("expected Content-Type to be text/event-stream, got instead: %q", ct)
+	}
+	if body := w.Body.String(); body != "data: event 1\n\ndata: event 2\n\n" {
+		t.Errorf("expected two events, got instead: %q", body)
+	}
+	if !w.Flushed {
+		t.Error("expected response to be flushed")
+	}
+	w = serveTest(s, newTestRequest("EventService.Events", &Service1Request{A: -1}))
+	if w.Code != 500 || !strings.Contains(w.Body.String(), "no events") {
+		t.Errorf("expected a 500 with the method error, got instead: %d %q", w.Code, w.Body.String())
+	}
+	if w = serveTest(s, newTestRequest("rpc.listMethods", &ListMethodsArgs{})); w.Code != 200 {
+		t.Errorf("expected methods to be listed, got instead: %d %q", w.Code, w.Body.String())
+	}
+}
+
+// slowReader delays each read, as a client trickling its request body.
+type slowReader struct {
+	r     *bytes.Reader
+	delay time.Duration
+}
+
+func (r *slowReader) Read(b []byte) (int, error) {
+	time.Sleep(r.delay)
+	if len(b) > 1 {
+		b = b[:1]
+	}
+	return r.r.Read(b)
+}
+
+func TestReadTimeout(t *testing.T) {
+	s := newTestServer(t)
+	s.SetReadTimeout(50 * time.Millisecond)
+	if w := serveTest(s, newTestRequest("Service1.Multiply", &Service1Request{4, 2})); w.Code != 200 {
+		t.Errorf("expected status 200, got instead: %d", w.Code)
+	}
+	buf, _ := json.Marshal(map[string]interface{}{"method": "Service1.Multiply", "params": &Service1Request{4, 2}})
+	r, _ := http.NewRequest("POST", "http://localhost:8080/", &slowReader{bytes.NewReader(buf), 5 * time.Millisecond})
+	r.Header.Set("Content-Type", "application/json")
+	r.RemoteAddr = "127.0.0.1:8080"
+	w := serveTest(s, r)
+	if w.Code != 408 {
+		t.Errorf("expected status 408, got instead: %d", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), ErrReadTimeout.Error()) {
+		t.Errorf("expected %q, got instead: %q", ErrReadTimeout, w.Body.String())
+	}
+}
+
+type notFoundErr string
+
+func (e notFoundErr) Error() string   { return string(e) }
+func (e notFoundErr) HTTPStatus() int { return 404 }
+
+type ResourceService struct{}
+
+func (t *ResourceService) Get(r *http.Request, req *Service1Request, res *Service1Response) error {
+	if req.A != 1 {
+		return notFoundErr("no such resource")
+	}
+	res.Result = 1
+	return nil
+}
+
+func TestHTTPStatusError(t *testing.T) {
+	s := newTestServer(t)
+	s.RegisterService(new(ResourceService), "")
+	w := serveTest(s, newTestRequest("ResourceService.Get", &Service1Request{A: 2}))
+	if w.Code != 404 {
+		t.Errorf("expected status 404, got instead: %d", w.Code)
+	}
+	var res testResponse
+	if err := json.NewDecoder(w.Body).Decode(&res); err != nil || res.Error != "no such resource" {
+		t.Errorf("expected the error in the body, got instead: %v (%v)", res.Error, err)
+	}
+	if w = serveTest(s, newTestRequest("ResourceService.Get", &Service1Request{A: 1})); w.Code != 200 {
+		t.Errorf("expected status 200, got instead: %d", w.Code)
+	}
+}
+
+type LegacyService struct{}
+
+func (t *LegacyService) Get(r *http.Request, req *Service1Request, res *Service1Response) error {
+	return &RenderedError{Status: 422, ContentType: "text/plain", Body: []byte("ERR 7 bad input\n")}
+}
+
+func TestRenderedError(t *testing.T) {
+	s := newTestServer(t)
+	s.RegisterService(new(LegacyService), "")
+	w := serveTest(s, newTestRequest("LegacyService.Get", &Service1Request{}))
+	if w.Code != 422 {
+		t.Errorf("expected status 422, got instead: %d", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "text/plain" {
+		t.Errorf("expected Content-Type text/plain, got instead: %q", ct)
+	}
+	if body := w.Body.String(); body != "ERR 7 bad input\n" {
+		t.Errorf("expected the rendered body, got instead: %q", body)
+	}
+}
+
+type RequiredService struct {
+	called bool
+}
+
+type RequiredRequest struct {
+	Name  *string  `rpc:"required"`
+	Tags  []string `rpc:"required"`
+	Count int
+}
+
+func (t *RequiredService) Greet(r *http.Request, req *RequiredRequest, res *string) error {
+	t.called = true
+	*res = "hello " + *req.Name
+	return nil
+}
+
+func TestRequiredFields(t *testing.T) {
+	s := newTestServer(t)
+	service := new(RequiredService)
+	s.RegisterService(service, "")
+	w := serveTest(s, newTestRequest("RequiredService.Greet", map[string]interface{}{"Count": 1}))
+	if w.Code != 400 || !strings.Contains(w.Body.String(), "rpc: missing required fields: Name, Tags") {
+		t.Errorf("expected 400 listing Name and Tags, got instead: %d %q", w.Code, w.Body.String())
+	}
+	if service.called {
+		t.Error("expected the method not to be called")
+	}
+	w = serveTest(s, newTestRequest("RequiredService.Greet", map[string]interface{}{"Name": "bob", "Tags": []string{"a"}}))
+	if w.Code != 200 || !strings.Contains(w.Body.String(), "hello bob") {
+		t.Errorf("expected 200 and hello bob, got instead: %d %q", w.Code, w.Body.String())
+	}
+}
+
+type JobService struct{}
+
+type JobReply struct {
+	Token string
+}
+
+func (t *JobService) Start(r *http.Request, req *Service1Request, res *JobReply) error {
+	res.Token = "job-42"
+	return ErrAccepted
+}
+
+func TestAccepted(t *testing.T) {
+	s := newTestServer(t)
+	s.RegisterService(new(JobService), "")
+	var callErr error
+	s.SetMetricsObserver(func(method string, status int, latency time.Duration, err error) {
+		callErr = err
+	})
+	w := serveTest(s, newTestRequest("JobService.Start", &Service1Request{}))
+	if w.Code != 202 {
+		t.Errorf("expected status 202, got instead: %d", w.Code)
+	}
+	if body := w.Body.String(); !strings.Contains(body, `"result":{"Token":"job-42"}`) {
+		t.Errorf("expected the tracking token as a result, got instead: %q", body)
+	}
+	if callErr != nil {
+		t.Errorf("expected the call to be reported as successful, got instead: %v", callErr)
+	}
+}
+
+func BenchmarkMultiply(b *testing.B) {
+	s := NewServer()
+	s.RegisterCodec(new(testCodec), "application/json")
+	s.RegisterService(new(Service1), "")
+	body, _ := json.Marshal(map[string]interface{}{"method": "Service1.Multiply", "params": &Service1Request{4, 2}})
+	w := httptest.NewRecorder()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		r.RemoteAddr = "127.0.0.1:8080"
+		w.Body.Reset()
+		s.ServeHTTP(w, r)
+	}
+}
+
+type RelayService struct{}
+
+func (t *RelayService) Forward(r *http.Request, req *RawBody, res *string) error {
+	*res = string(*req)
+	return nil
+}
+
+func TestRawBodyArgs(t *testing.T) {
+	s := newTestServer(t)
+	if err := s.RegisterService(new(RelayService), ""); err != nil {
+		t.Fatal("expected err to be nil, got instead:", err)
+	}
+	r := newTestRequest("RelayService.Forward", map[string]int{"A": 4})
+	body, _ := ioutil.ReadAll(r.Body)
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	var res struct{ Result string }
+	if err := json.NewDecoder(serveTest(s, r).Body).Decode(&res); err != nil || res.Result != string(body) {
+		t.Errorf("expected the posted body %q, got instead: %q (%v)", body, res.Result, err)
+	}
+	if w := serveTest(s, newTestRequest("Service1.Multiply", &Service1Request{4, 2})); !strings.Contains(w.Body.String(), `"Result":8`) {
+		t.Errorf("expected other methods to decode their args, got instead: %q", w.Body.String())
+	}
+}
+
+type LifecycleService struct {
+	fail   error
+	inits  int
+	closes int
+}
+
+func (t *LifecycleService) Init() error {
+	t.inits++
+	return t.fail
+}
+
+func (t *LifecycleService) Close() error {
+	t.closes++
+	return nil
+}
+
+func (t *LifecycleService) Inits(r *http.Request, req *Service1Request, res *int) error {
+	*res = t.inits
+	return nil
+}
+
+func TestServiceLifecycle(t *testing.T) {
+	s := newTestServer(t)
+	service := new(LifecycleService)
+	if err := s.RegisterService(service, ""); err != nil {
+		t.Fatal("expected err to be nil, got instead:", err)
+	}
+	if service.inits != 1 {
+		t.Errorf("expected Init to be called once, got instead: %d", service.inits)
+	}
+	if w := serveTest(s, newTestRequest("LifecycleService.Inits", &Service1Request{})); !strings.Contains(w.Body.String(), `"result":1`) {
+		t.Errorf("expected the initialized service to be called, got instead: %s", w.Body.String())
+	}
+	if err := s.UnregisterService("LifecycleService"); err != nil {
+		t.Fatal("expected err to be nil, got instead:", err)
+	}
+	if service.closes != 1 {
+		t.Errorf("expected Close to be called once, got instead: %d", service.closes)
+	}
+	if w := serveTest(s, newTestRequest("LifecycleService.Inits", &Service1Request{})); w.Code != 404 {
+		t.Errorf("expected w.Code to be 404 once unregistered, got instead: %d", w.Code)
+	}
+	if err := s.UnregisterService("LifecycleService"); err == nil {
+		t.Error("expected err unregistering an unknown service")
+	}
+
+	failing := &LifecycleService{fail: errors.New("cache unavailable")}
+	if err := s.RegisterService(failing, ""); err == nil || !strings.Contains(err.Error(), "cache unavailable") {
+		t.Errorf("expected the Init error, got instead: %v", err)
+	}
+	if s.HasMethod("LifecycleService.Inits") {
+		t.Error("expected registration to be aborted")
+	}
+
+	aliased := new(LifecycleService)
+	if err := s.RegisterServiceAliases(aliased, "Old", "New"); err != nil {
+		t.Fatal("expected err to be nil, got instead:", err)
+	}
+	if err := s.Close(); err != nil || aliased.inits != 1 || aliased.closes != 1 {
+		t.Errorf("expected one Init and one Close, got instead: %d and %d (%v)", aliased.inits, aliased.closes, err)
+	}
+}
+
+func TestServiceLifecycleAliases(t *testing.T) {
+	s := newTestServer(t)
+	service := new(LifecycleService)
+	if err := s.RegisterServiceAliases(service, "Old", "New"); err != nil {
+		t.Fatal("expected err to be nil, got instead:", err)
+	}
+	if err := s.UnregisterService("Old"); err != nil || service.closes != 0 {
+		t.Errorf("expected Close not to be called while aliased, got instead: %d (%v)", service.closes, err)
+	}
+	if !s.HasMethod("New.Inits") {
+		t.Error("expected the alias to remain registered")
+	}
+	if err := s.UnregisterService("New"); err != nil || service.closes != 1 {
+		t.Errorf("expected Close to be called once, got instead: %d (%v)", service.closes, err)
+	}
+
+	old, replacement := new(LifecycleService), new(LifecycleService)
+	if err := s.RegisterServiceAliases(old, "Old", "New"); err != nil {
+		t.Fatal("expected err to be nil, got instead:", err)
+	}
+	if err := s.ReplaceService(replacement, "Old"); err != nil || old.closes != 0 {
+		t.Errorf("expected Close not to be called while aliased, got instead: %d (%v)", old.closes, err)
+	}
+	if err := s.ReplaceService(replacement, "New"); err != nil || old.closes != 1 {
+		t.Errorf("expected the replaced service to be closed once, got instead: %d (%v)", old.closes, err)
+	}
+	if replacement.closes != 0 {
+		t.Errorf("expected the replacement not to be closed, got instead: %d", replacement.closes)
+	}
+}
+
+type CounterService struct {
+	calls int
+}
+
+func (t *CounterService) Next(r *http.Request, req *Service1Request, res *int) error {
+	t.calls++
+	*res = t.calls
+	return nil
+}
+
+func TestIdempotency(t *testing.T) {
+	s := newTestServer(t)
+	counter := new(CounterService)
+	s.RegisterService(counter, "")
+	s.EnableIdempotency(time.Minute)
+	send := func(key string) *httptest.ResponseRecorder {
+		r := newTestRequest("CounterService.Next", &Service1Request{})
+		r.Header.Set(IdempotencyKeyHeader, key)
+		return serveTest(s, r)
+	}
+	first := send("key-1")
+	second := send("key-1")
+	if counter.calls != 1 {
+		t.Errorf("expected the method to be called once, got instead: %d", counter.calls)
+	}
+	if second.Code != first.Code || second.Body.String() != first.Body.String() || second.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("expected the cached response %q, got instead: %d %q", first.Body.String(), second.Code, second.Body.String())
+	}
+	if w := send("key-2"); !strings.Contains(w.Body.String(), `"result":2`) || counter.calls != 2 {
+		t.Errorf("expected a new key to call the method, got instead: %q", w.Body.String())
+	}
+
+	block := newBlockService()
+	s.RegisterService(block, "")
+	served := make(chan int)
+	go func() {
+		r := newTestRequest("BlockService.Block", &Service1Request{})
+		r.Header.Set(IdempotencyKeyHeader, "key-3")
+		served <- serveTest(s, r).Code
+	}()
+	<-block.started
+	r := newTestRequest("BlockService.Block", &Service1Request{})
+	r.Header.Set(IdempotencyKeyHeader, "key-3")
+	if w := serveTest(s, r); w.Code != 409 {
+		t.Errorf("expected w.Code to be 409 while in flight, got instead: %d", w.Code)
+	}
+	close(block.release)
+	if code := <-served; code != 200 {
+		t.Errorf("expected in flight request status to be 200, got instead: %d", code)
+	}
+}
+
+func TestIdempotencyScope(t *testing.T) {
+	s := newTestServer(t)
+	counter := new(CounterService)
+	s.RegisterService(counter, "")
+	s.EnableIdempotency(time.Minute)
+	send := func(remoteAddr string, args *Service1Request) *httptest.ResponseRecorder {
+		r := newTestRequest("CounterService.Next", args)
+		r.RemoteAddr = remoteAddr
+		r.Header.Set(IdempotencyKeyHeader, "key-1")
+		return serveTest(s, r)
+	}
+	if w := send("127.0.0.1:8080", &Service1Request{}); w.Code != 200 || counter.calls != 1 {
+		t.Fatalf("expected the method to be called, got instead: %d %q", w.Code, w.Body.String())
+	}
+	if w := send("10.0.0.2:8080", &Service1Request{}); !strings.Contains(w.Body.String(), `"result":2`) {
+		t.Errorf("expected another client not to get the cached response, got instead: %q", w.Body.String())
+	}
+	if w := send("127.0.0.1:8080", &Service1Request{A: 1}); !strings.Contains(w.Body.String(), `"result":3`) {
+		t.Errorf("expected another body not to get the cached response, got instead: %q", w.Body.String())
+	}
+	if w := send("127.0.0.1:8080", &Service1Request{}); !strings.Contains(w.Body.String(), `"result":1`) {
+		t.Errorf("expected the cached response, got instead: %q", w.Body.String())
+	}
+
+	s.Bind(net.ParseIP("10.0.0.2"))
+	if w := send("127.0.0.1:8080", &Service1Request{}); w.Code != 403 {
+		t.Errorf("expected a client rejected by Bind to get a 403 while its key is cached, got instead: %d %q", w.Code, w.Body.String())
+	}
+	s.Drain()
+	if w := send("10.0.0.2:8080", &Service1Request{}); w.Code != 503 {
+		t.Errorf("expected a 503 while draining, got instead: %d %q", w.Code, w.Body.String())
+	}
+	if counter.calls != 3 {
+		t.Errorf("expected the method to be called 3 times, got instead: %d", counter.calls)
+	}
+}
+
+func TestIdempotencyGzip(t *testing.T) {
+	s := newTestServer(t)
+	counter := new(CounterService)
+	s.RegisterService(counter, "")
+	s.EnableIdempotency(time.Minute)
+	s.SetGzipMinSize(0)
+	s.SetRequestID(true)
+	send := func(encoding string) *httptest.ResponseRecorder {
+		r := newTestRequest("CounterService.Next", &Service1Request{})
+		r.Header.Set(IdempotencyKeyHeader, "key-1")
+		r.Header.Set("Accept-Encoding", encoding)
+		return serveTest(s, r)
+	}
+	first := send("gzip")
+	if enc := first.Header().Get("Content-Encoding"); enc != "gzip" {
+		t.Fatalf("expected the first reply to be gzipped, got instead: %q", enc)
+	}
+	gz, err := gzip.NewReader(first.Body)
+	if err != nil {
+		t.Fatal("expected err to be nil, got instead:", err)
+	}
+	body, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatal("expected err to be nil, got instead:", err)
+	}
+
+	retry := send("identity")
+	if counter.calls != 1 {
+		t.Errorf("expected the method to be called once, got instead: %d", counter.calls)
+	}
+	if enc := retry.Header().Get("Content-Encoding"); enc != "" {
+		t.Errorf("expected the retry reply to be uncompressed, got instead: %q", enc)
+	}
+	if retry.Body.String() != string(body) {
+		t.Errorf("expected the cached response %q, got instead: %q", body, retry.Body.String())
+	}
+	if id := retry.Header().Get(RequestIDHeader); id == "" || id == first.Header().Get(RequestIDHeader) {
+		t.Errorf("expected a new request id, got instead: %q", id)
+	}
+
+	again := send("gzip")
+	if enc := again.Header().Get("Content-Encoding"); enc != "gzip" || len(again.Header()["Vary"]) != 1 {
+		t.Errorf("expected the retry reply to be gzipped once, got instead: %q %q", enc, again.Header()["Vary"])
+	}
+}
+
+type TagsRequest struct {
+	Tags  []string
+	Attrs map[string]*Service1Request
+}
+
+type TagsService struct {
+	got TagsRequest
+}
+
+func (t *TagsService) Tag(r *http.Request, req *TagsRequest, res *int) error {
+	t.got = *req
+	return nil
+}
+
+func TestHookArgs(t *testing.T) {
+	s := newTestServer(t)
+	service := new(TagsService)
+	s.RegisterService(service, "")
+	s.RegisterBeforeFunc(func(i *RequestInfo) error {
+		if i.Method == "Service1.Multiply" {
+			i.Args.Interface().(*Service1Request).A = 100
+		} else {
+			args := i.Args.Interface().(*TagsRequest)
+			args.Tags[0] = "changed"
+			args.Attrs["a"].A = 100
+		}
+		return nil
+	})
+	var seen []interface{}
+	s.RegisterAfterFunc(func(i *RequestInfo) {
+		seen = append(seen, i.Args.Elem().Interface())
+	})
+
+	if w := serveTest(s, newTestRequest("Service1.Multiply", &Service1Request{4, 2})); !strings.Contains(w.Body.String(), `"Result":8`) {
+		t.Errorf("expected the method to get the decoded args, got instead: %s", w.Body.String())
+	}
+	serveTest(s, newTestRequest("TagsService.Tag", &TagsRequest{[]string{"x"}, map[string]*Service1Request{"a": {A: 1}}}))
+	if service.got.Tags[0] != "x" || service.got.Attrs["a"].A != 1 {
+		t.Errorf("expected the method to get the decoded args, got instead: %+v", service.got)
+	}
+	if len(seen) != 2 || seen[0] != (Service1Request{4, 2}) || seen[1].(TagsRequest).Tags[0] != "x" {
+		t.Errorf("expected after funcs to observe the decoded args, got instead: %+v", seen)
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2013 X-Formation. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+)
+
+// ErrStreamNotSupported is returned when a streaming method is called
+// through a codec unable to encode streams.
+var ErrStreamNotSupported = errors.New("rpc: codec does not support streaming")
+
+// Stream is received instead of the *reply argument by streaming methods,
+// which send their results incrementally:
+//
+//    func (t *T) Method(r *http.Request, args *Args, stream rpc.Stream) error
+//
+// Each chunk is encoded by the codec and flushed to the client as soon as it
+// is sent.
+type Stream interface {
+	Send(chunk interface{}) error
+}
+
+// StreamCodecRequest is implemented by codec requests able to encode the
+// chunks sent by streaming methods.
+type StreamCodecRequest interface {
+	CodecRequest
+	// Writes a single chunk of a streamed response. The error parameter is
+	// the error returned by the method call, if any, in which case it is
+	// the last chunk written.
+	WriteChunk(http.ResponseWriter, interface{}, error) error
+}
+
+// stream writes the chunks sent by a method through the codec.
+type stream struct {
+	w        http.ResponseWriter
+	codecReq StreamCodecRequest
+}
+
+// Send encodes a chunk and flushes it to the client.
+func (s *stream) Send(chunk interface{}) error {
+	if err := s.codecReq.WriteChunk(s.w, chunk, nil); err != nil {
+		return err
+	}
+	if f, ok := s.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+// callStream invokes a streaming method, writing the method error, if any,
+// as the last chunk of the response.
+func (s *Server) callStream(w *responseWriter, r *http.Request, service *service, method *serviceMethod, codecReq CodecRequest, args reflect.Value) error {
+	streamReq, ok := codecReq.(StreamCodecRequest)
+	if !ok {
+		s.writeError(w, r, 400, ErrStreamNotSupported.Error())
+		return ErrStreamNotSupported
+	}
+	_, errResult, _ := s.call(r, nil, service, method, args, reflect.ValueOf(&stream{w, streamReq}))
+	if errResult != nil {
+		if errWrite := streamReq.WriteChunk(w, nil, errResult); errWrite != nil {
+			return errWrite
+		}
+	}
+	return errResult
+}
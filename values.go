@@ -0,0 +1,235 @@
+// Copyright 2013 X-Formation. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// QueryCodecRequest is implemented by codec requests able to complete the
+// method args with the parameters of the URL query.
+type QueryCodecRequest interface {
+	// ReadQuery fills the request object for the RPC method, as ReadRequest
+	// does, then assigns the query values to its fields. The request body
+	// may omit the args.
+	ReadQuery(query url.Values, args interface{}) error
+}
+
+// AllowQueryArgs makes the server fill the args of the given method with the
+// parameters of the URL query too, overriding the values read from the
+// request body. The method itself is still read by the codec, unless the
+// body is empty: the method is then read from the "method" query parameter,
+// the args only from the query, and the response is encoded by the codec if
+// it implements ResponseEncoder.
+//
+// The query values are assigned as documented by DecodeValues. Codecs not
+// implementing QueryCodecRequest must still read the args from the body.
+//
+// The method uses a dotted notation as in "Service.Method", matched as by
+// SetCaseInsensitiveMethods.
+func (s *Server) AllowQueryArgs(method string) {
+	if s.query == nil {
+		s.query = make(map[string]bool)
+	}
+	s.query[method] = true
+}
+
+// RawBody is the args type of methods receiving the request body as sent,
+// without decoding it, e.g. to forward it:
+//
+//	func (t *T) Method(r *http.Request, args *rpc.RawBody, reply *Reply) error
+//
+// The codec still reads the method name from the request, and encodes the
+// reply.
+type RawBody []byte
+
+// recordingReader keeps a copy of the bytes read from a request body, so
+// they can be passed to methods taking a RawBody once the codec read them.
+type recordingReader struct {
+	io.ReadCloser
+	buf bytes.Buffer
+}
+
+func (r *recordingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.buf.Write(p[:n])
+	return n, err
+}
+
+// queryAllowed returns true if the method was allowed by AllowQueryArgs,
+// ignoring the case of its name if the server does.
+func (s *Server) queryAllowed(method string) bool {
+	if s.query[method] {
+		return true
+	}
+	if !s.services.folding() {
+		return false
+	}
+	for name := range s.query {
+		if strings.EqualFold(name, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// newQueryRequest returns the CodecRequest of a request with an empty body to
+// a method allowed by AllowQueryArgs, or nil if the request must be read by
+// the codec.
+func (s *Server) newQueryRequest(r *http.Request, codec Codec, method string) CodecRequest {
+	encoder, ok := codec.(ResponseEncoder)
+	if !ok || len(s.query) == 0 {
+		return nil
+	}
+	name := method
+	if name == "" {
+		if name = r.URL.Query().Get("method"); name != "" && s.rewriter != nil {
+			name = s.rewriter(name)
+		}
+	}
+	if name == "" || !s.queryAllowed(name) || !emptyBody(r) {
+		return nil
+	}
+	return queryRequest{encoderRequest{encoder}, r.URL.Query().Get("method")}
+}
+
+// queryRequest is the CodecRequest of a request with an empty body, whose
+// method and args are read from the URL query.
+type queryRequest struct {
+	encoderRequest
+	method string
+}
+
+func (c queryRequest) Method() (string, error) {
+	return c.method, nil
+}
+
+// ReadRequest leaves the args to be assigned the query values.
+func (c queryRequest) ReadRequest(interface{}) error {
+	return nil
+}
+
+// emptyBody returns true if a request has no body, otherwise putting back
+// the byte read to find out.
+func emptyBody(r *http.Request) bool {
+	if r.Body == nil || r.Body == http.NoBody {
+		return true
+	}
+	var b [1]byte
+	n, err := r.Body.Read(b[:])
+	if n == 0 {
+		return err == io.EOF
+	}
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(b[:n]), r.Body), r.Body}
+	return false
+}
+
+// readArgs decodes the method args, merging in the URL query parameters for
+// methods allowed by AllowQueryArgs.
+func (s *Server) readArgs(r *http.Request, codecReq CodecRequest, method string, args interface{}) error {
+	if raw, ok := args.(*RawBody); ok {
+		if body, ok := r.Body.(*recordingReader); ok {
+			if _, err := ioutil.ReadAll(body); err != nil {
+				return err
+			}
+			*raw = body.buf.Bytes()
+		}
+		return nil
+	}
+	if !s.queryAllowed(method) {
+		return codecReq.ReadRequest(args)
+	}
+	if queryReq, ok := codecReq.(QueryCodecRequest); ok {
+		return queryReq.ReadQuery(r.URL.Query(), args)
+	}
+	if err := codecReq.ReadRequest(args); err != nil {
+		return err
+	}
+	return DecodeValues(r.URL.Query(), args)
+}
+
+// DecodeValues fills the struct pointed to by args from URL values, e.g. a
+// parsed query string or form.
+//
+// Each value is assigned to the exported field of the same name, compared
+// case-insensitively, and converted to the field type. Supported field types
+// are strings, booleans, integers, floating point numbers and slices of
+// those. Values without a matching field are ignored.
+func DecodeValues(values url.Values, args interface{}) error {
+	v := reflect.ValueOf(args)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("rpc: cannot decode values into %T", args)
+	}
+	v = v.Elem()
+	for key, vals := range values {
+		if len(vals) == 0 {
+			continue
+		}
+		field := v.FieldByNameFunc(func(name string) bool {
+			return strings.EqualFold(name, key)
+		})
+		if !field.IsValid() || !field.CanSet() {
+			continue
+		}
+		if field.Kind() == reflect.Slice {
+			slice := reflect.MakeSlice(field.Type(), len(vals), len(vals))
+			for i, val := range vals {
+				if err := setValue(slice.Index(i), val); err != nil {
+					return fmt.Errorf("rpc: cannot decode %q: %s", key, err)
+				}
+			}
+			field.Set(slice)
+		} else if err := setValue(field, vals[0]); err != nil {
+			return fmt.Errorf("rpc: cannot decode %q: %s", key, err)
+		}
+	}
+	return nil
+}
+
+// setValue converts a string to the type of v and assigns it.
+func setValue(v reflect.Value, s string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(s, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}